@@ -0,0 +1,88 @@
+package gobgp
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+)
+
+type aggregatePrefix struct {
+	n uint32
+	m uint8
+}
+
+/*
+	Aggregate the list of prefixes into the smallest list of prefixes covering
+	exactly the same address space, covered prefixes are dropped and adjacent
+	prefixes are merged into shorter ones. Invalid and non-IPv4 prefixes are
+	returned unchanged.
+*/
+func Aggregate(prefixes []string) (ret []string) {
+	var list []aggregatePrefix
+	for _, v := range prefixes {
+		afi, n, m, err := parsePrefix(v)
+		if err != nil || afi != afiIPv4 {
+			ret = append(ret, v)
+			continue
+		}
+		list = append(list, aggregatePrefix{n: binary.BigEndian.Uint32(n), m: m})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].n != list[j].n {
+			return list[i].n < list[j].n
+		}
+		return list[i].m < list[j].m
+	})
+
+	var stack []aggregatePrefix
+	for _, v := range list {
+		/*
+			Skip prefixes covered by the previous one
+		*/
+		if len(stack) > 0 && stack[len(stack)-1].covers(v) {
+			continue
+		}
+		stack = append(stack, v)
+
+		/*
+			Merge the two topmost prefixes while they are siblings
+		*/
+		for len(stack) > 1 {
+			a := stack[len(stack)-2]
+			b := stack[len(stack)-1]
+			if a.m != b.m || a.m == 0 || a.n^b.n != 1<<(32-a.m) || a.n&(1<<(32-a.m)) != 0 {
+				break
+			}
+			stack = stack[:len(stack)-2]
+			stack = append(stack, aggregatePrefix{n: a.n, m: a.m - 1})
+		}
+	}
+
+	for _, v := range stack {
+		ret = append(ret, v.String())
+	}
+
+	return
+}
+
+/*
+	Check whether the prefix covers the other one
+*/
+func (p aggregatePrefix) covers(o aggregatePrefix) bool {
+	if o.m < p.m {
+		return false
+	}
+	mask := uint32(0)
+	if p.m > 0 {
+		mask = ^uint32(0) << (32 - p.m)
+	}
+	return o.n&mask == p.n
+}
+
+func (p aggregatePrefix) String() string {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, p.n)
+	n := net.IPNet{IP: ip, Mask: net.CIDRMask(int(p.m), 32)}
+	return n.String()
+}
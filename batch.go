@@ -0,0 +1,235 @@
+package gobgp
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+	Send UPDATE message to the BGP peer, the message is collected
+	and sent later coalesced with others if batching is enabled
+*/
+func (b *BGP) sendUpdate(m MsgUpdate) error {
+	if b.batchWindow == 0 {
+		return b.queueUpdate(m)
+	}
+
+	b.batchMu.Lock()
+	b.pending = append(b.pending, m)
+	if len(b.pending) >= b.batchSize {
+		b.batchMu.Unlock()
+		return b.Flush()
+	}
+	if b.batchCancel == nil {
+		cancel := make(chan struct{})
+		b.batchCancel = cancel
+		go func() {
+			select {
+			case <-cancel:
+				return
+			case <-b.clock.After(b.batchWindow):
+			}
+			if err := b.Flush(); err != nil {
+				b.reportError("Flush", err)
+			}
+		}()
+	}
+	b.batchMu.Unlock()
+
+	return nil
+}
+
+/*
+	Immediately send all collected updates to the BGP peer
+*/
+func (b *BGP) Flush() (err error) {
+	b.batchMu.Lock()
+	p := b.pending
+	resend := b.resendPending && b.State() == StateEstablished
+	if resend {
+		/*
+			Whole database after a reconnect, followed by the changes
+		*/
+		b.resendPending = false
+		var all []MsgUpdate
+		for _, v := range b.routes() {
+			all = append(all, v)
+		}
+		p = append(all, p...)
+	}
+	b.pending = nil
+	if b.batchCancel != nil {
+		close(b.batchCancel)
+		b.batchCancel = nil
+	}
+	b.batchMu.Unlock()
+
+	if resend {
+		b.sendWeighted()
+	}
+
+	if len(p) == 0 {
+		return
+	}
+
+	b.debug("%s: Flushing %d collected updates", b.peer, len(p))
+	params := b.sessionParams()
+	for _, m := range coalesceUpdates(p) {
+		for _, v := range splitUpdate(m, params) {
+			if e := b.queueUpdate(v); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+
+	return
+}
+
+/*
+	Re-advertise only the routes matching the predicate, batched into the
+	minimal number of updates, after a change of the export policy. The
+	matching routes rejected by the current export policy are withdrawn.
+*/
+func (b *BGP) RefreshAffected(f func(prefix string, m MsgUpdate) bool) (err error) {
+	if b.State() != StateEstablished {
+		return fmt.Errorf("RefreshAffected: Session not established")
+	}
+	if err = b.Flush(); err != nil {
+		return
+	}
+
+	var p []MsgUpdate
+	for k, m := range b.routes() {
+		if !f(k, m) {
+			continue
+		}
+		if b.exportAllowed(k, m) {
+			p = append(p, m)
+		} else {
+			p = append(p, MsgUpdate{Withdrawns: []string{k}})
+		}
+	}
+	if len(p) == 0 {
+		return
+	}
+
+	b.debug("%s: Refreshing %d affected routes", b.peer, len(p))
+	params := b.sessionParams()
+	for _, m := range coalesceUpdates(p) {
+		for _, v := range splitUpdate(m, params) {
+			if e := b.queueUpdate(v); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+
+	return
+}
+
+/*
+	Coalesce the updates into the minimal number of updates, withdrawals are
+	joined together and announcements sharing the same attributes as well.
+	Only the last change of each prefix is kept.
+*/
+func coalesceUpdates(in []MsgUpdate) (ret []MsgUpdate) {
+	withdrawn := make(map[string]bool)
+	announced := make(map[string]string)
+	attrs := make(map[string]MsgUpdate)
+	var order []string
+	var keys []string
+
+	for _, m := range in {
+		for _, v := range m.Withdrawns {
+			if _, e := withdrawn[v]; !e {
+				if _, a := announced[v]; !a {
+					order = append(order, v)
+				}
+			}
+			withdrawn[v] = true
+			delete(announced, v)
+		}
+		if len(m.Prefixes) == 0 {
+			continue
+		}
+		a := m
+		a.Withdrawns = nil
+		a.Prefixes = nil
+		k := fmt.Sprintf("%#v", a)
+		if _, e := attrs[k]; !e {
+			attrs[k] = a
+			keys = append(keys, k)
+		}
+		for _, v := range m.Prefixes {
+			if _, e := announced[v]; !e {
+				if _, w := withdrawn[v]; !w {
+					order = append(order, v)
+				}
+			}
+			announced[v] = k
+			delete(withdrawn, v)
+		}
+	}
+
+	var w MsgUpdate
+	groups := make(map[string]*MsgUpdate)
+	for _, v := range order {
+		if withdrawn[v] {
+			w.Withdrawns = append(w.Withdrawns, v)
+			continue
+		}
+		k := announced[v]
+		g, ok := groups[k]
+		if !ok {
+			x := attrs[k]
+			g = &x
+			groups[k] = g
+		}
+		g.Prefixes = append(g.Prefixes, v)
+	}
+
+	if len(w.Withdrawns) > 0 {
+		ret = append(ret, w)
+	}
+	for _, k := range keys {
+		if g, ok := groups[k]; ok {
+			ret = append(ret, *g)
+		}
+	}
+
+	return
+}
+
+/*
+	Split the update into multiple ones not exceeding the maximum message length
+	and the maximum number of prefixes
+*/
+func splitUpdate(m MsgUpdate, p sessionParams) []MsgUpdate {
+	if len(m.Prefixes)+len(m.Withdrawns) < 2 {
+		return []MsgUpdate{m}
+	}
+	n := p.MaxPrefixesPerUpdate
+	if n <= 0 || (len(m.Prefixes) <= n && len(m.Withdrawns) <= n) {
+		x := p
+		x.ExtendedMessage = true
+		msg, err := marshalMessageUpdate(m, x)
+		if err == nil && len(msg) <= p.maxLength() {
+			return []MsgUpdate{m}
+		}
+		if err != nil && !errors.Is(err, ErrMessageTooLong) {
+			return []MsgUpdate{m}
+		}
+	}
+
+	a, c := m, m
+	if len(m.Withdrawns) > 1 {
+		h := len(m.Withdrawns) / 2
+		a.Withdrawns, c.Withdrawns = m.Withdrawns[:h], m.Withdrawns[h:]
+		a.Prefixes = nil
+	} else {
+		h := len(m.Prefixes) / 2
+		a.Prefixes, c.Prefixes = m.Prefixes[:h], m.Prefixes[h:]
+		c.Withdrawns = nil
+	}
+
+	return append(splitUpdate(a, p), splitUpdate(c, p)...)
+}
@@ -1,9 +1,14 @@
 package gobgp
 
 import (
-	"bytes"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -16,65 +21,587 @@ const (
 	defaultDebugTimeFormat = "2006-01-02 15:04:05.000000000"
 
 	processQueueLength = 1000
+
+	/*
+		Default maximum number of AS numbers in a received AS path
+	*/
+	defaultMaxASPathLength = 512
+
+	/*
+		Default timeout of writes to the BGP peer
+	*/
+	defaultWriteTimeout = 10 * time.Second
+
+	/*
+		Default number of collected updates which triggers sending
+	*/
+	defaultBatchSize = 100
+
+	/*
+		Default next hop of blackholed prefixes, TEST-NET-1 address
+		expected to be routed to the discard interface by the peer
+	*/
+	defaultBlackholeNextHop = "192.0.2.1"
 )
 
 type BgpConfig struct {
 	/*
-		Router ID in dotted format
+		Router ID in dotted format, the BGP identifier sent in the OPEN
+		message, commonly a loopback address not used as the session source.
+		Derived from the local address or the highest IPv4 address of
+		the local interfaces if empty.
+	*/
+	RouterID string
+
+	/*
+		Local IP address the TCP session is connected from, chosen by
+		the system if empty, not related to the RouterID once set
+	*/
+	LocalAddress string
+
+	/*
+		Allow the peer address to be one of the local addresses,
+		for intentional testing over the loopback
+	*/
+	AllowLocalPeer bool
+
+	/*
+		Transport carrying the BGP session, TCP from the LocalAddress if nil
+	*/
+	Transport Transport
+
+	/*
+		Wrap the transport in TLS if set, this is non-standard and not
+		RFC BGP-over-TLS, so it works only between speakers using this library
+	*/
+	TLSConfig *tls.Config
+
+	/*
+		Local AS number, numbers above 65535 are advertised as AS_TRANS
+		in the OPEN message together with the 4-octet AS capability
+	*/
+	ASN uint32
+
+	/*
+		Hold time in seconds, zero disables KEEPALIVE messages and the hold
+		timer, otherwise at least 3 seconds
+	*/
+	HoldTime uint16
+
+	/*
+		Interval of the connection attempts, 120 seconds if zero
+	*/
+	ConnectRetryTime time.Duration
+
+	/*
+		Interval of the KEEPALIVE messages, 1/3 of the negotiated hold time
+		if zero, longer intervals are capped to it
+	*/
+	KeepaliveTime time.Duration
+
+	/*
+		IPv4 address of the peer
+	*/
+	Peer string
+
+	/*
+		TCP port connected to and listened on by the Collector, 179 if zero.
+		Listening on 179 requires root or the CAP_NET_BIND_SERVICE capability,
+		use a high port for unprivileged testing.
+	*/
+	Port uint16
+
+	/*
+		Maximum number of AS numbers accepted in a received AS path,
+		longer paths are answered by a Malformed AS_PATH notification
+	*/
+	MaxASPathLength uint
+
+	/*
+		Refuse received updates with an unrecognized well-known attribute
+		by the Unrecognized Well-known Attribute notification, RFC 4271,
+		such attributes are skipped if not set
+	*/
+	StrictAttributes bool
+
+	/*
+		Maximum number of prefixes received from the peer, the session is
+		closed by the Maximum Number of Prefixes Reached notification when
+		exceeded, unlimited if zero
+	*/
+	MaxPrefixes uint32
+
+	/*
+		Warning thresholds in percent of MaxPrefixes, OnPrefixThreshold is
+		called when the number of received prefixes reaches each of them
+	*/
+	PrefixThresholds []int
+
+	/*
+		Refuse to advertise the prefixes of the Martians list
+		by ErrMartianPrefix
+	*/
+	RejectMartians bool
+
+	/*
+		Do not close the session on a received NOTIFICATION message, it is
+		only reported, the session is closed when the peer closes the
+		connection. Useful for observing the peer without reconnecting.
+	*/
+	ContinueOnNotification bool
+
+	/*
+		Maximum number of concurrent sessions accepted by the collector,
+		the connections beyond it are refused by the Connection Rejected
+		notification, unlimited if zero
+	*/
+	MaxSessions int
+
+	/*
+		Do not prepend the local AS to the AS path of the routes advertised
+		to eBGP peers, for applications managing the AS path themselves
+	*/
+	DisableASPrepend bool
+
+	/*
+		Number of occurrences of the local AS number tolerated in an AS path
+		received from an eBGP peer, routes with more are dropped as looped
+	*/
+	AllowOwnAS uint
+
+	/*
+		Aggregate prefixes added by AddBatch before advertising them, only
+		the resulting prefixes are stored, see AddBatch
+	*/
+	AggregateBatch bool
+
+	/*
+		Next hop of the prefixes advertised by Blackhole, default 192.0.2.1
+	*/
+	BlackholeNextHop string
+
+	/*
+		Timeout of a single write to the BGP peer, the session is restarted
+		when it expires
+	*/
+	WriteTimeout time.Duration
+
+	/*
+		Time for which outbound updates are collected and coalesced
+		before sending, zero sends every update immediately
+	*/
+	BatchWindow time.Duration
+
+	/*
+		Delay of the first reconnect attempt after the session drops,
+		giving the peer time to tear down its side, zero reconnects
+		at the next regular attempt
+	*/
+	ReconnectDelay time.Duration
+
+	/*
+		Number of collected updates which triggers sending before
+		the batch window expires
+	*/
+	BatchSize int
+
+	/*
+		Filter of the received routes, routes for which it returns false
+		are kept in the Adj-RIB-In but not passed to the update handler
+	*/
+	ImportPolicy func(prefix string, m MsgUpdate) bool
+
+	/*
+		Filter of the advertised routes, routes for which it returns false
+		are kept in the internal database but not sent to the peer. Both
+		policies are set per peer by the configuration passed to AddPeer,
+		the route server consults the policies of the source and the
+		destination client.
+	*/
+	ExportPolicy func(prefix string, m MsgUpdate) bool
+
+	/*
+		Origin validation of the received routes, the result is set
+		in the ValidationState of the update passed to the import policy
+		and to the update handler. The state signalled by the peer
+		is used if nil.
+	*/
+	Validator func(prefix string, originAS uint32) ValidationState
+
+	/*
+		Route flap damping of the received routes, disabled if nil,
+		suppressed routes are kept in the Adj-RIB-In but not passed
+		to the update handler
+	*/
+	Damping *Damping
+
+	/*
+		Advertise support of messages up to 65535 octets, RFC 8654
+	*/
+	ExtendedMessages bool
+
+	/*
+		Advertise the multiprotocol capability for IPv4 unicast, RFC 4760,
+		the routes are encoded in MP_REACH_NLRI and MP_UNREACH_NLRI
+		instead of the legacy NLRI if the peer advertises it too
+	*/
+	MultiprotocolIPv4 bool
+
+	/*
+		Advertise the multiprotocol capability for IPv4 flow specification,
+		RFC 8955, required by AddFlowSpec
+	*/
+	FlowSpec bool
+
+	/*
+		Advertise the ADD-PATH capability sending multiple paths of IPv4
+		unicast prefixes, RFC 7911, required by AddWeighted
+	*/
+	AddPath bool
+
+	/*
+		Additional capabilities advertised in the OPEN message to the peer,
+		the capabilities enabled by other options are added automatically
+	*/
+	Capabilities []Capability
+
+	/*
+		Length of the queue returned by Events, zero disables the events
+	*/
+	EventQueueLength int
+
+	/*
+		Length of the queue of outbound updates written to the peer by
+		a dedicated goroutine, zero writes the updates by the caller
+	*/
+	SendQueueLength int
+
+	/*
+		Block the caller when the send queue is full instead of returning
+		ErrSendQueueFull, ErrSendQueueFull is returned while not connected
+	*/
+	SendQueueBlock bool
+
+	/*
+		Maximum number of announced and of withdrawn prefixes in a single
+		UPDATE message built by the batching, for peers failing on large
+		updates, limited by the message length only if zero
+	*/
+	MaxPrefixesPerUpdate int
+
+	/*
+		Source of time for the timers and the debug messages,
+		the system clock if nil
+	*/
+	Clock Clock
+
+	/*
+		Called after all prefixes of the internal database were resent
+		to the peer once the session got Established
+	*/
+	OnSynced func(peer string)
+
+	/*
+		Do not resend the internal database after a reconnect, the database
+		is resent by the next Flush called by the application instead
+	*/
+	DisableResendOnReconnect bool
+
+	/*
+		Called after each attempt to connect to the peer with its result
+	*/
+	OnConnectAttempt func(addr string, err error)
+
+	/*
+		Called when the peer closes the session by the Administrative Shutdown
+		or Administrative Reset notification, with the shutdown communication
+		message of RFC 8203 if present. The EventNotification is emitted too.
+	*/
+	OnPeerShutdown func(reason string)
+
+	/*
+		Called when the number of received prefixes reaches the threshold
+		in percent of the limit, again only after it drops below
+	*/
+	OnPrefixThreshold func(pct int, count, limit uint32)
+
+	/*
+		Called when a prefix of the Martians list is being advertised,
+		before it is refused if RejectMartians is set
+	*/
+	OnMartian func(prefix string)
+
+	/*
+		Called with every transport and protocol error of the session
+		together with its context, the errors are printed as well
+	*/
+	OnError func(err error)
+
+	/*
+		Enabled / disabled debugging messages
+	*/
+	DebugEnabled bool
+
+	/*
+		Datetime prefix for debug messages
+	*/
+	DebugTimeFormat string
+}
+
+type BGP struct {
+	/*
+		Router ID
+	*/
+	id string
+
+	/*
+		Local AS number
+	*/
+	as uint32
+
+	/*
+		Hold time in seconds
+	*/
+	hold uint16
+
+	/*
+		Hold time negotiated with the peer, smaller of the local and the peer's one
+	*/
+	negotiatedHold uint16
+
+	/*
+		Remote peer address:port
+	*/
+	peer string
+
+	/*
+		Transport carrying the BGP session
+	*/
+	transport Transport
+
+	/*
+		Timeout of a single write to the BGP peer
+	*/
+	writeTimeout time.Duration
+
+	/*
+		Time for which outbound updates are collected
+	*/
+	batchWindow time.Duration
+
+	/*
+		Delay of the first reconnect attempt after the session drops
+	*/
+	reconnectDelay time.Duration
+
+	/*
+		Configured interval of the KEEPALIVE messages
+	*/
+	keepaliveTime time.Duration
+
+	/*
+		Timers of the session FSM
+	*/
+	connectRetryTimer *fsmTimer
+	keepaliveTimer    *fsmTimer
+	holdTimer         *fsmTimer
+
+	/*
+		Number of collected updates which triggers sending
+	*/
+	batchSize int
+
+	/*
+		Collected outbound updates waiting for the batch window expiration
+	*/
+	pending []MsgUpdate
+
+	/*
+		Cancels the send of the collected updates on the batch window
+		expiration, nil if no window is running
+	*/
+	batchCancel chan struct{}
+
+	/*
+		Guards the collected updates
+	*/
+	batchMu sync.Mutex
+
+	/*
+		Source of time for the timers
+	*/
+	clock Clock
+
+	/*
+		Is the connection active and should be reconnected?
+	*/
+	running bool
+
+	/*
+		Maximum number of AS numbers accepted in a received AS path
+	*/
+	maxASPathLength uint
+
+	/*
+		Refuse unrecognized well-known attributes
+	*/
+	strictAttributes bool
+
+	/*
+		Maximum number of received prefixes, unlimited if zero
+	*/
+	maxPrefixes uint32
+
+	/*
+		Sorted warning thresholds in percent of the limit
+	*/
+	prefixThresholds []int
+
+	/*
+		Thresholds reached by the number of received prefixes
+	*/
+	thresholdsCrossed map[int]bool
+
+	/*
+		Refuse to advertise martian prefixes
+	*/
+	rejectMartians bool
+
+	/*
+		Keep the session on a received NOTIFICATION message
+	*/
+	continueOnNotification bool
+
+	/*
+		Maximum number of prefixes in a single batched update
+	*/
+	maxPrefixesPerUpdate int
+
+	/*
+		Do not prepend the local AS on eBGP sessions
+	*/
+	disableASPrepend bool
+
+	/*
+		Number of occurrences of the local AS number tolerated in an AS path
+	*/
+	allowOwnAS uint
+
+	/*
+		Aggregate prefixes added by AddBatch before advertising them
+	*/
+	aggregateBatch bool
+
+	/*
+		Next hop of the blackholed prefixes
+	*/
+	blackholeNextHop string
+
+	/*
+		AS number of the peer received in its OPEN message
+	*/
+	peerAS uint32
+
+	/*
+		Hold time and BGP identifier received in the OPEN message of the peer
+	*/
+	peerHold uint16
+	peerID   string
+
+	/*
+		Parameters negotiated for the session
+	*/
+	params sessionParams
+
+	/*
+		Advertise support of extended messages
+	*/
+	extendedMessages bool
+
+	/*
+		Advertise the multiprotocol capability for IPv4 unicast
+	*/
+	multiprotocolIPv4 bool
+
+	/*
+		Advertise the multiprotocol capability for IPv4 flow specification
+	*/
+	flowSpec bool
+
+	/*
+		Flow specification rules advertised to the BGP peer
+	*/
+	flowSpecs map[string]FlowSpecRule
+
+	/*
+		Advertise the ADD-PATH capability for sending
+	*/
+	addPath bool
+
+	/*
+		Prefixes advertised over multiple paths, one update per path
+	*/
+	weighted map[string][]MsgUpdate
+
+	/*
+		Cancellation of the periodic refresh of the prefixes
+	*/
+	refresh map[string]chan struct{}
+
+	/*
+		Additional capabilities advertised in the OPEN message
 	*/
-	RouterID string
+	extraCapabilities []Capability
 
 	/*
-		Local AS number
+		State of the BGP finite state machine
 	*/
-	ASN uint16
+	state State
 
 	/*
-		Hold time in seconds
+		Time the session became Established, zero if it is not
 	*/
-	HoldTime uint16
+	established time.Time
 
 	/*
-		IPv4 address of the peer
+		Ring buffer of recent state transitions
 	*/
-	Peer string
+	transitions [transitionHistoryLength]Transition
 
 	/*
-		Enabled / disabled debugging messages
+		Position of the next transition in the ring buffer
 	*/
-	DebugEnabled bool
+	transitionNext int
 
 	/*
-		Datetime prefix for debug messages
+		Queue of events for the application, nil if disabled
 	*/
-	DebugTimeFormat string
-}
+	events chan Event
 
-type BGP struct {
 	/*
-		Router ID
+		Queue of outbound updates, nil if disabled
 	*/
-	id string
+	sendQueue chan MsgUpdate
 
 	/*
-		Local AS number
+		Block the caller when the send queue is full
 	*/
-	as uint16
+	sendQueueBlock bool
 
 	/*
-		Hold time in seconds
+		Closed when the send queue writer exits
 	*/
-	hold uint16
+	sendQueueDone chan struct{}
 
 	/*
-		Remote peer address:port
+		Runtime statistics
 	*/
-	peer string
+	stats Stats
 
 	/*
-		Is the connection active and should be reconnected?
+		Guards the state, the statistics and the internal prefixes database
 	*/
-	running bool
+	mu sync.Mutex
 
 	/*
 		Internal prefixes database
@@ -82,9 +609,60 @@ type BGP struct {
 	db map[string]MsgUpdate
 
 	/*
-		Underlying TCP connection
+		Prefix tree of the internal prefixes database
+	*/
+	trie *prefixTrie
+
+	/*
+		Time of the last change of the prefixes in the internal database
+	*/
+	advertised map[string]time.Time
+
+	/*
+		Routes received from the peer before applying the import policy
+	*/
+	adjRibIn map[string]MsgUpdate
+
+	/*
+		Received prefixes accepted by the import policy
+	*/
+	imported map[string]bool
+
+	/*
+		Origin validation of the received routes
+	*/
+	validator func(prefix string, originAS uint32) ValidationState
+
+	/*
+		Route flap damping parameters, disabled if nil
+	*/
+	damping *Damping
+
+	/*
+		Penalties of the flapping received prefixes
+	*/
+	damped map[string]*dampState
+
+	/*
+		Filter of the received routes
+	*/
+	importPolicy func(prefix string, m MsgUpdate) bool
+
+	/*
+		Filter of the advertised routes
+	*/
+	exportPolicy func(prefix string, m MsgUpdate) bool
+
+	/*
+		Underlying transport connection
 	*/
-	conn net.Conn
+	conn io.ReadWriteCloser
+
+	/*
+		Generation of the connection, increased by each disconnect to drop
+		the messages received on the previous connection
+	*/
+	connGen uint64
 
 	/*
 		Enabled / disabled debugging messages
@@ -96,15 +674,120 @@ type BGP struct {
 	*/
 	debugTimeFormat string
 
+	/*
+		Destination of debugging messages
+	*/
+	debugOutput io.Writer
+
 	/*
 		Used for serial processing of received messages
 	*/
 	ch chan message
 
+	/*
+		Guards sending to the channel against closing it
+	*/
+	chMu sync.Mutex
+
+	/*
+		Serializes the messages written to the BGP peer
+	*/
+	writeMu sync.Mutex
+
+	/*
+		Closed when the instance is being stopped
+	*/
+	stopping chan struct{}
+
+	/*
+		Closed when all received messages were processed
+	*/
+	processed chan struct{}
+
+	/*
+		Tracks the goroutines started by Connect
+	*/
+	wg sync.WaitGroup
+
 	/*
 		Application defined function for handling update messages
 	*/
 	updateHandler func(m MsgUpdate)
+
+	/*
+		Application defined function called after the resend of all prefixes
+	*/
+	onSynced func(peer string)
+
+	/*
+		Do not resend the internal database after a reconnect
+	*/
+	disableResend bool
+
+	/*
+		The internal database is to be resent by the next Flush
+	*/
+	resendPending bool
+
+	/*
+		Outbound updates to the peer are suppressed
+	*/
+	paused bool
+
+	/*
+		Withdrawals suppressed while paused, sent on resume
+	*/
+	suppressed []MsgUpdate
+
+	/*
+		The session is being shut down, only the withdrawals are sent
+	*/
+	shuttingDown bool
+
+	/*
+		Parameters of the draining, nil if not draining
+	*/
+	drain *DrainOptions
+
+	/*
+		Cancels the delayed withdrawal of the draining
+	*/
+	drainCancel chan struct{}
+
+	/*
+		Routes are advertised with the GRACEFUL_SHUTDOWN community
+	*/
+	gracefulShutdown bool
+
+	/*
+		Application defined function called after each connection attempt
+	*/
+	onConnectAttempt func(addr string, err error)
+
+	/*
+		Application defined function called when the peer shuts the session down
+	*/
+	onPeerShutdown func(reason string)
+
+	/*
+		Application defined function called when a prefix threshold is reached
+	*/
+	onPrefixThreshold func(pct int, count, limit uint32)
+
+	/*
+		Application defined function called on martian prefixes
+	*/
+	onMartian func(prefix string)
+
+	/*
+		Application defined function called on errors
+	*/
+	onError func(err error)
+
+	/*
+		Called on each state change, used by the route server
+	*/
+	onStateChange func(from, to State)
 }
 
 /*
@@ -114,63 +797,209 @@ func New(c BgpConfig, uf func(m MsgUpdate)) (*BGP, error) {
 	var b BGP
 
 	/*
-		Validate Router ID
+		Enable / disable debugging messages
+	*/
+	b.debugEnabled = c.DebugEnabled
+	b.debugOutput = os.Stdout
+
+	/*
+		Set date/time format for debugging messages
 	*/
-	if net.ParseIP(c.RouterID).To4() == nil {
-		return &b, fmt.Errorf("New: Invalid Router ID")
+	if len(c.DebugTimeFormat) > 0 {
+		// Application specified
+		b.debugTimeFormat = c.DebugTimeFormat
+	} else {
+		// Hardcoded default
+		b.debugTimeFormat = defaultDebugTimeFormat
+	}
+
+	/*
+		Set source of time
+	*/
+	if c.Clock != nil {
+		// Application specified
+		b.clock = c.Clock
+	} else {
+		// System clock
+		b.clock = realClock{}
 	}
-	b.id = c.RouterID
 
 	/*
-		Validate AS number
+		Validate the configuration
 	*/
-	if c.ASN == 0 {
-		return &b, fmt.Errorf("New: Invalid AS number")
+	if err := c.Validate(); err != nil {
+		return &b, fmt.Errorf("New: %w", err)
+	}
+
+	/*
+		Set transport
+	*/
+	if c.Transport != nil {
+		// Application specified
+		b.transport = c.Transport
+	} else {
+		// TCP from the local address
+		b.transport = TCPTransport{LocalAddress: c.LocalAddress}
+	}
+	if c.TLSConfig != nil {
+		b.transport = TLSTransport{Transport: b.transport, Config: c.TLSConfig}
 	}
-	b.as = c.ASN
 
 	/*
-		Validate hold time
+		Set Router ID, derive it if not specified
 	*/
-	if c.HoldTime < 3 {
-		return &b, fmt.Errorf("New: Hold time too small")
+	if len(c.RouterID) == 0 {
+		id, err := deriveRouterID(net.ParseIP(c.LocalAddress))
+		if err != nil {
+			return &b, fmt.Errorf("New: %v", err)
+		}
+		b.debug("New: Using derived Router ID %s", id)
+		c.RouterID = id
 	}
+	b.id = c.RouterID
+
+	b.as = c.ASN
 	b.hold = c.HoldTime
 
 	/*
-		Validate peer IP address
+		Set peer address
 	*/
 	p, err := parsePeerAddress(c.Peer)
 	if err != nil {
 		return &b, fmt.Errorf("New: Invalid peer IP address")
 	}
-	b.peer = fmt.Sprintf("%s:%d", p, bgpPort)
+	b.peer = net.JoinHostPort(p, strconv.Itoa(int(c.port())))
 
 	/*
-		Initialise internal prefixes database
+		Refuse to peer with ourselves unless intended
 	*/
-	b.db = make(map[string]MsgUpdate)
+	if !c.AllowLocalPeer {
+		local, err := isLocalAddress(p)
+		if err != nil {
+			return &b, fmt.Errorf("New: %v", err)
+		}
+		if local {
+			return &b, fmt.Errorf("New: %w: %s", ErrLocalPeer, p)
+		}
+	}
 
 	/*
-		Enable / disable debugging messages
+		Set maximum length of a received AS path
 	*/
-	b.debugEnabled = c.DebugEnabled
+	if c.MaxASPathLength > 0 {
+		// Application specified
+		b.maxASPathLength = c.MaxASPathLength
+	} else {
+		// Hardcoded default
+		b.maxASPathLength = defaultMaxASPathLength
+	}
+	b.strictAttributes = c.StrictAttributes
+	b.maxPrefixes = c.MaxPrefixes
+	b.prefixThresholds = sortThresholds(c.PrefixThresholds)
+	b.thresholdsCrossed = make(map[int]bool)
+	b.rejectMartians = c.RejectMartians
+	b.continueOnNotification = c.ContinueOnNotification
+	b.maxPrefixesPerUpdate = c.MaxPrefixesPerUpdate
+	b.disableASPrepend = c.DisableASPrepend
 
 	/*
-		Set date/time format for debugging messages
+		Set next hop of the blackholed prefixes
 	*/
-	if len(c.DebugTimeFormat) > 0 {
+	if len(c.BlackholeNextHop) > 0 {
 		// Application specified
-		b.debugTimeFormat = c.DebugTimeFormat
+		b.blackholeNextHop = c.BlackholeNextHop
 	} else {
 		// Hardcoded default
-		b.debugTimeFormat = defaultDebugTimeFormat
+		b.blackholeNextHop = defaultBlackholeNextHop
 	}
 
 	/*
-		Initialise channel for message processor
+		Set write timeout
 	*/
-	b.ch = make(chan message, processQueueLength)
+	if c.WriteTimeout > 0 {
+		// Application specified
+		b.writeTimeout = c.WriteTimeout
+	} else {
+		// Hardcoded default
+		b.writeTimeout = defaultWriteTimeout
+	}
+
+	/*
+		Set batching of outbound updates
+	*/
+	b.batchWindow = c.BatchWindow
+	b.reconnectDelay = c.ReconnectDelay
+
+	/*
+		Set timers of the session FSM
+	*/
+	retry := defaultConnectRetryTime
+	if c.ConnectRetryTime > 0 {
+		// Application specified
+		retry = c.ConnectRetryTime
+	}
+	b.keepaliveTime = c.KeepaliveTime
+	b.connectRetryTimer = newFSMTimer(b.clock, retry)
+	b.keepaliveTimer = newFSMTimer(b.clock, 0)
+	b.holdTimer = newFSMTimer(b.clock, 0)
+	if c.BatchSize > 0 {
+		// Application specified
+		b.batchSize = c.BatchSize
+	} else {
+		// Hardcoded default
+		b.batchSize = defaultBatchSize
+	}
+
+	b.allowOwnAS = c.AllowOwnAS
+	b.extendedMessages = c.ExtendedMessages
+	b.multiprotocolIPv4 = c.MultiprotocolIPv4
+	b.flowSpec = c.FlowSpec
+	b.flowSpecs = make(map[string]FlowSpecRule)
+	b.addPath = c.AddPath
+	b.weighted = make(map[string][]MsgUpdate)
+	b.refresh = make(map[string]chan struct{})
+	b.extraCapabilities = c.Capabilities
+	b.aggregateBatch = c.AggregateBatch
+
+	/*
+		Initialise internal prefixes database
+	*/
+	b.db = make(map[string]MsgUpdate)
+	b.trie = newPrefixTrie()
+	b.advertised = make(map[string]time.Time)
+
+	/*
+		Initialise Adj-RIB-In
+	*/
+	b.adjRibIn = make(map[string]MsgUpdate)
+	b.imported = make(map[string]bool)
+	b.importPolicy = c.ImportPolicy
+	b.exportPolicy = c.ExportPolicy
+	b.validator = c.Validator
+
+	/*
+		Initialise route flap damping if enabled
+	*/
+	if c.Damping != nil {
+		d := c.Damping.withDefaults()
+		b.damping = &d
+	}
+	b.damped = make(map[string]*dampState)
+
+	/*
+		Initialise queue of events if enabled
+	*/
+	if c.EventQueueLength > 0 {
+		b.events = make(chan Event, c.EventQueueLength)
+	}
+
+	/*
+		Initialise queue of outbound updates if enabled
+	*/
+	if c.SendQueueLength > 0 {
+		b.sendQueue = make(chan MsgUpdate, c.SendQueueLength)
+	}
+	b.sendQueueBlock = c.SendQueueBlock
 
 	/*
 		Set the update messages handler function
@@ -182,72 +1011,348 @@ func New(c BgpConfig, uf func(m MsgUpdate)) (*BGP, error) {
 		// Hardcoded empty default
 		b.updateHandler = func(m MsgUpdate) {}
 	}
+	b.onSynced = c.OnSynced
+	b.disableResend = c.DisableResendOnReconnect
+	b.onConnectAttempt = c.OnConnectAttempt
+	b.onPeerShutdown = c.OnPeerShutdown
+	b.onPrefixThreshold = c.OnPrefixThreshold
+	b.onMartian = c.OnMartian
+	b.onError = c.OnError
 
 	return &b, nil
 }
 
 /*
-	Start the BGP instance and required goroutines
+	Start the BGP instance and required goroutines
+*/
+func (b *BGP) Connect() error {
+	if b.running {
+		return fmt.Errorf("Connect: Alredy running")
+	}
+	if err := b.connect(); err != nil {
+		return err
+	}
+
+	/*
+		Initialise channel for message processor
+	*/
+	b.ch = make(chan message, processQueueLength)
+	b.stopping = make(chan struct{})
+	b.processed = make(chan struct{})
+	b.sendQueueDone = make(chan struct{})
+
+	b.running = true
+	b.spawn(b.processReply)
+	b.spawn(b.connection)
+	b.spawn(b.keepalive)
+	b.spawn(b.holdWatchdog)
+	b.spawn(b.readReply)
+	if b.damping != nil {
+		b.spawn(b.dampingReuse)
+	}
+	if b.sendQueue != nil {
+		b.spawn(b.sendQueueWriter)
+	}
+	return nil
+}
+
+/*
+	Run the function in a goroutine tracked by Wait
+*/
+func (b *BGP) spawn(f func()) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		f()
+	}()
+}
+
+/*
+	Wait until all goroutines started by Connect return after Disconnect,
+	must not be called from the update handler
+*/
+func (b *BGP) Wait() {
+	b.wg.Wait()
+}
+
+/*
+	Stop the BGP instance
+*/
+func (b *BGP) Disconnect() error {
+	if !b.running {
+		return fmt.Errorf("Disconnect: Not running")
+	}
+	b.stop()
+	return nil
+}
+
+/*
+	Stop the BGP instance and wait up to the timeout for the already
+	received messages to be processed
+*/
+func (b *BGP) DisconnectGraceful(timeout time.Duration) error {
+	if !b.running {
+		return fmt.Errorf("DisconnectGraceful: Not running")
+	}
+	b.stop()
+
+	select {
+	case <-b.processed:
+		return nil
+	case <-b.clock.After(timeout):
+		return fmt.Errorf("DisconnectGraceful: Timeout waiting for received messages")
+	}
+}
+
+/*
+	Send the pending updates, close the connection and the receive queue
+*/
+func (b *BGP) stop() {
+	if err := b.Flush(); err != nil {
+		b.reportError("Disconnect", err)
+	}
+	close(b.stopping)
+	if b.sendQueue != nil {
+		<-b.sendQueueDone
+	}
+	b.chMu.Lock()
+	b.running = false
+	close(b.ch)
+	b.chMu.Unlock()
+	b.disconnect("Stopped")
+}
+
+/*
+	Tear down the session with the Administrative Reset notification and let it
+	be re-established, the internal database is resent to the BGP peer afterwards
 */
-func (b *BGP) Connect() error {
-	if b.running {
-		return fmt.Errorf("Connect: Alredy running")
-	}
-	if err := b.connect(); err != nil {
-		return err
+func (b *BGP) Reset() error {
+	if !b.running {
+		return fmt.Errorf("Reset: Not running")
 	}
-	b.running = true
-	go b.processReply()
-	go b.connection()
-	go b.keepalive()
-	go b.readReply()
+	// Cease, Administrative Reset
+	b.reset(4)
 	return nil
 }
 
 /*
-	Stop the BGP instance
+	Change the hold time, the running session is reset to renegotiate it
 */
-func (b *BGP) Disconnect() error {
-	if !b.running {
-		return fmt.Errorf("Disconnect: Not running")
+func (b *BGP) SetHoldTime(h uint16) error {
+	if h > 0 && h < 3 {
+		return fmt.Errorf("SetHoldTime: %w", ErrHoldTimeTooSmall)
+	}
+	b.mu.Lock()
+	b.hold = h
+	b.mu.Unlock()
+
+	if b.running {
+		// Cease, Other Configuration Change
+		b.reset(6)
 	}
-	b.running = false
-	b.disconnect()
-	close(b.ch)
 	return nil
 }
 
 /*
-	Add prefix to the internal database and send update to the BGP peer
+	Tear down the session with the Cease notification of the subcode,
+	the connection is re-established later
 */
-func (b *BGP) Add(p string, o uint, a TypeAsPath, n []string) error {
-	if _, e := b.db[p]; e {
-		return fmt.Errorf("Add: Prefix %s alredy exists", p)
+func (b *BGP) reset(subcode uint8) {
+	b.debug("%s: Resetting the session", b.peer)
+	if b.conn != nil {
+		if err := b.sendNotification(6, subcode, ""); err != nil {
+			b.reportError("reset", err)
+		}
 	}
-	b.debug("Adding prefix %s", p)
+	b.disconnect("Reset")
+}
+
+/*
+	Add prefix to the internal database and send update to the BGP peer,
+	exactly one next hop is required, ErrMultipleNextHops is returned otherwise.
+	The NextHopUnspecified is sent as it is.
+*/
+func (b *BGP) Add(p string, o Origin, a TypeAsPath, n []string) error {
+	var m MsgUpdate
+	m.Origin = o
+	m.AsPath = a
+	m.NextHops = n
+	return b.AddUpdate(p, m)
+}
+
+/*
+	Add prefix with the communities to the internal database and send update
+	to the BGP peer
+*/
+func (b *BGP) AddWithCommunities(p string, o Origin, a TypeAsPath, n []string, c []uint32) error {
 	var m MsgUpdate
-	m.Prefixes = []string{p}
 	m.Origin = o
 	m.AsPath = a
 	m.NextHops = n
-	_, err := marshalMessageUpdate(m)
+	m.Communities = c
+	return b.AddUpdate(p, m)
+}
+
+/*
+	Add prefix with all attributes of the update to the internal database
+	and send it to the BGP peer. The Prefixes of the update are either empty
+	or the single prefix, withdrawals and flow specification are refused.
+*/
+func (b *BGP) AddUpdate(p string, m MsgUpdate) error {
+	switch {
+	case len(m.Prefixes) > 1 || (len(m.Prefixes) == 1 && m.Prefixes[0] != p):
+		return fmt.Errorf("AddUpdate: Prefixes of the update do not match %s", p)
+	case len(m.Withdrawns) > 0:
+		return fmt.Errorf("AddUpdate: Withdrawals not allowed")
+	case len(m.FlowSpec) > 0 || len(m.FlowSpecWithdrawns) > 0:
+		return fmt.Errorf("AddUpdate: Flow specification not allowed, use AddFlowSpec")
+	}
+	m.Prefixes = []string{p}
+	return b.add(m)
+}
+
+/*
+	Add the single prefix update to the internal database and send it to the BGP peer
+*/
+func (b *BGP) add(m MsgUpdate) error {
+	p := m.Prefixes[0]
+	if b.Exists(p) {
+		return fmt.Errorf("Add: Prefix %s alredy exists", p)
+	}
+	b.debug("Adding prefix %s", p)
+	_, err := marshalMessageUpdate(m, b.validationParams())
 	if err != nil {
 		return err
 	}
-	b.db[p] = m
+	if err := b.checkMartian(p); err != nil {
+		return fmt.Errorf("Add: %w", err)
+	}
+	if !b.storeRoutes([]MsgUpdate{m}) {
+		return fmt.Errorf("Add: Prefix %s alredy exists", p)
+	}
 	return b.sendUpdate(m)
 }
 
+/*
+	Store the single prefix updates in the internal database, nothing
+	is stored and false is returned if any of the prefixes already exists
+*/
+func (b *BGP) storeRoutes(ms []MsgUpdate) bool {
+	now := b.clock.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, m := range ms {
+		if b.exists(m.Prefixes[0]) {
+			return false
+		}
+	}
+	for _, m := range ms {
+		p := m.Prefixes[0]
+		b.db[p] = m
+		b.trie.insert(p)
+		b.advertised[p] = now
+	}
+	return true
+}
+
+/*
+	Add multiple prefixes sharing the same attributes to the internal database
+	and send them to the BGP peer split into as few updates as the session
+	allows. The prefixes are aggregated first if enabled, the internal database
+	then holds the aggregates in place of the aggregated prefixes, which are
+	not found by Exists and Get and have to be withdrawn by the aggregate.
+*/
+func (b *BGP) AddBatch(p []string, o Origin, a TypeAsPath, n []string) error {
+	var plain, aggregated MsgUpdate
+	plain.Origin = o
+	plain.AsPath = a
+	plain.NextHops = n
+	aggregated = plain
+	aggregated.AtomicAggregate = true
+	aggregated.Aggregator = TypeAggregator{ASN: b.as, Address: b.id}
+
+	if b.aggregateBatch {
+		orig := make(map[string]bool)
+		for _, v := range p {
+			orig[v] = true
+		}
+		for _, v := range Aggregate(p) {
+			if orig[v] {
+				plain.Prefixes = append(plain.Prefixes, v)
+			} else {
+				aggregated.Prefixes = append(aggregated.Prefixes, v)
+			}
+		}
+	} else {
+		plain.Prefixes = p
+	}
+
+	for _, m := range []MsgUpdate{plain, aggregated} {
+		for _, v := range m.Prefixes {
+			if b.Exists(v) {
+				return fmt.Errorf("AddBatch: Prefix %s alredy exists", v)
+			}
+			if err := b.checkMartian(v); err != nil {
+				return fmt.Errorf("AddBatch: %w", err)
+			}
+		}
+		if len(m.Prefixes) == 0 {
+			continue
+		}
+		params := b.validationParams()
+		for _, v := range splitUpdate(m, params) {
+			if _, err := marshalMessageUpdate(v, params); err != nil {
+				return err
+			}
+		}
+	}
+
+	var ms []MsgUpdate
+	for _, m := range []MsgUpdate{plain, aggregated} {
+		for _, v := range m.Prefixes {
+			ms = append(ms, singlePrefix(m, v))
+		}
+	}
+	if !b.storeRoutes(ms) {
+		return fmt.Errorf("AddBatch: Prefixes alredy exist")
+	}
+
+	for _, m := range []MsgUpdate{plain, aggregated} {
+		if len(m.Prefixes) == 0 {
+			continue
+		}
+		b.debug("Adding prefixes %v", m.Prefixes)
+		for _, v := range splitUpdate(m, b.sessionParams()) {
+			if err := b.sendUpdate(v); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 /*
 	Delete prefix from the internal database and send update to the BGP peer
 */
 func (b *BGP) Del(x string) error {
+	b.mu.Lock()
+	if _, ok := b.weighted[x]; ok {
+		b.mu.Unlock()
+		return b.delWeighted(x)
+	}
 	m, ok := b.db[x]
+	if ok {
+		delete(b.db, x)
+		b.trie.remove(x)
+		delete(b.advertised, x)
+	}
+	b.mu.Unlock()
 	if !ok {
 		return fmt.Errorf("Del: Prefix %s not found", x)
 	}
 	b.debug("Removing prefix %s", x)
-	delete(b.db, x)
+	b.cancelRefresh(x)
 	m.Withdrawns = m.Prefixes
 	m.Prefixes = []string{}
 	return b.sendUpdate(m)
@@ -257,10 +1362,65 @@ func (b *BGP) Del(x string) error {
 	Check whether the specified prefix is or is not in the internal database
 */
 func (b *BGP) Exists(x string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.exists(x)
+}
+
+/*
+	Check the internal database for the prefix, the caller holds the lock
+*/
+func (b *BGP) exists(x string) bool {
+	if _, ok := b.weighted[x]; ok {
+		return true
+	}
 	_, ok := b.db[x]
 	return ok
 }
 
+/*
+	Return the update of the prefix from the internal database
+*/
+func (b *BGP) Get(x string) (MsgUpdate, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m, ok := b.db[x]
+	return m, ok
+}
+
+/*
+	Return the time the prefix was added to the internal database
+*/
+func (b *BGP) AdvertisedAt(x string) (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, ok := b.advertised[x]
+	return t, ok
+}
+
+/*
+	Return the copy of the routes in the internal database
+*/
+func (b *BGP) routes() map[string]MsgUpdate {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ret := make(map[string]MsgUpdate, len(b.db))
+	for k, v := range b.db {
+		ret[k] = v
+	}
+	return ret
+}
+
+/*
+	Print the error with its context and pass it to the application
+*/
+func (b *BGP) reportError(context string, err error) {
+	fmt.Println(context+":", err)
+	if b.onError != nil {
+		b.onError(fmt.Errorf("%s: %w", context, err))
+	}
+}
+
 func (b *BGP) EnableDebug() {
 	b.debugEnabled = true
 }
@@ -273,24 +1433,54 @@ func (b *BGP) SetDebugTimeFormat(p string) {
 	b.debugTimeFormat = p
 }
 
+/*
+	Redirect debugging messages to the writer, standard output if nil
+*/
+func (b *BGP) SetDebugOutput(w io.Writer) {
+	if w == nil {
+		w = os.Stdout
+	}
+	b.debugOutput = w
+}
+
 /*
 	Establish the connection to the BGP peer
 */
 func (b *BGP) connect() (err error) {
-	msg, err := marshalMessageOpen(msgOpen{ASN: b.as, HoldTime: b.hold, RouterID: b.id})
+	b.mu.Lock()
+	b.negotiatedHold = b.hold
+	b.shuttingDown = false
+	b.params = sessionParams{StrictAttributes: b.strictAttributes, MaxPrefixesPerUpdate: b.maxPrefixesPerUpdate}
+	b.mu.Unlock()
+
+	msg, err := b.MarshalOpen()
 	if err != nil {
 		return
 	}
 
+	b.setState(StateConnect, "Connecting")
 	b.debug("%s: Trying to connect", b.peer)
-	b.conn, err = net.Dial("tcp", b.peer)
+	c, err := b.transport.Dial(b.peer)
+	if err == nil {
+		b.mu.Lock()
+		b.conn = c
+		b.mu.Unlock()
+	}
+	if b.onConnectAttempt != nil {
+		b.onConnectAttempt(b.peer, err)
+	}
 	if err != nil {
+		b.setState(StateActive, err.Error())
 		return
 	}
 	b.debug("%s: Connected", b.peer)
 
 	b.debug("%s: Sending an OPEN message", b.peer)
-	_, err = b.conn.Write(msg)
+	err = b.write(msg)
+	if err != nil {
+		return
+	}
+	b.setState(StateOpenSent, "OPEN message sent")
 
 	return
 }
@@ -298,12 +1488,23 @@ func (b *BGP) connect() (err error) {
 /*
 	Close the connection to the BGP peer
 */
-func (b *BGP) disconnect() {
+func (b *BGP) disconnect(reason string) {
 	b.debug("%s: Disconnecting", b.peer)
-	if b.conn != nil {
-		b.conn.Close()
-		b.conn = nil
+	b.mu.Lock()
+	c := b.conn
+	b.conn = nil
+	b.connGen++
+	b.mu.Unlock()
+	if c != nil {
+		c.Close()
 	}
+	b.stopSessionTimers()
+	/*
+		The expired timer is stopped, re-armed for the next connection attempt
+	*/
+	b.connectRetryTimer.Reset()
+	b.clearAdjRibIn()
+	b.setState(StateIdle, reason)
 	b.debug("%s: Disconnected", b.peer)
 	return
 }
@@ -312,39 +1513,124 @@ func (b *BGP) disconnect() {
 	Periodically check the connection and restart if needed
 */
 func (b *BGP) connection() {
+	connected := false
 	for b.running {
+		if b.conn == nil && connected && b.reconnectDelay > 0 {
+			b.debug("%s: Connection lost, waiting %v before reconnecting", b.peer, b.reconnectDelay)
+			if !b.sleep(b.reconnectDelay) {
+				return
+			}
+			connected = false
+			continue
+		}
 		if b.conn == nil {
 			b.debug("%s: Not connected, trying to reconnect", b.peer)
+			b.connectRetryTimer.Reset()
 			if err := b.connect(); err != nil {
-				fmt.Println("connection:", err)
+				b.reportError("connection", err)
 			} else {
-				if len(b.db) > 0 {
-					b.debug("%s: Sending all learned prefixes", b.peer)
-				}
-				for _, v := range b.db {
-					if err := b.sendUpdate(v); err != nil {
-						fmt.Println("connection:", err)
-					}
-				}
+				connected = true
+				b.emit(Event{Type: EventReconnect})
 			}
 		}
-		time.Sleep(5 * time.Second)
+		if !b.connectRetryTimer.Wait(b.stopping) {
+			return
+		}
 	}
 }
 
 /*
-	Periodically send KEEPALIVE message to the BGP peer at interval 1/3 of HOLDTIME
+	Advertise the internal database and the flow specification rules once
+	the session is Established, no UPDATE message is sent before
 */
-func (b *BGP) keepalive() {
-	t := time.NewTicker(time.Duration(b.hold/3) * time.Second)
-	go b.sendKeepalive()
-	for range t.C {
-		if !b.running {
-			t.Stop()
-			return
+func (b *BGP) synchronize() {
+	if b.disableResend {
+		b.batchMu.Lock()
+		b.resendPending = true
+		b.batchMu.Unlock()
+		b.debug("%s: Resend of all learned prefixes left to the application", b.peer)
+	} else {
+		b.resendAll()
+	}
+	b.sendFlowSpecs()
+	if b.onSynced != nil {
+		b.onSynced(b.peer)
+	}
+}
+
+/*
+	Send all learned prefixes to the BGP peer
+*/
+func (b *BGP) resendAll() {
+	db := b.routes()
+	if len(db) > 0 {
+		b.debug("%s: Sending all learned prefixes", b.peer)
+	}
+	for _, v := range db {
+		if err := b.sendUpdate(v); err != nil {
+			b.reportError("resendAll", err)
 		}
-		go b.sendKeepalive()
 	}
+	b.sendWeighted()
+	if err := b.Flush(); err != nil {
+		b.reportError("resendAll", err)
+	}
+}
+
+/*
+	Return the capabilities advertised in the OPEN message
+*/
+func (b *BGP) capabilities() (ret []Capability) {
+	if b.extendedMessages {
+		ret = append(ret, Capability{Code: capabilityExtendedMessage})
+	}
+	if b.multiprotocolIPv4 {
+		ret = append(ret, multiprotocolCapability(afiIPv4, safiUnicast))
+	}
+	if b.flowSpec {
+		ret = append(ret, multiprotocolCapability(afiIPv4, safiFlowSpec))
+	}
+	if b.addPath {
+		ret = append(ret, addPathCapability(afiIPv4, safiUnicast, addPathSend))
+	}
+	for _, v := range b.extraCapabilities {
+		ret = appendCapability(ret, v)
+	}
+	return
+}
+
+/*
+	Return the OPEN message sent to the peer including the header,
+	with all capabilities enabled by the configuration
+*/
+func (b *BGP) MarshalOpen() ([]byte, error) {
+	b.mu.Lock()
+	hold := b.hold
+	b.mu.Unlock()
+	return marshalMessageOpen(msgOpen{ASN: b.as, HoldTime: hold, RouterID: b.id, Capabilities: b.capabilities()})
+}
+
+/*
+	Return the parameters negotiated for the session
+*/
+func (b *BGP) sessionParams() sessionParams {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.params
+}
+
+/*
+	Return the parameters used to validate the added routes, the empty
+	AS path is allowed until the peer is known to be in another AS
+*/
+func (b *BGP) validationParams() sessionParams {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p := b.params
+	if b.state != StateOpenConfirm && b.state != StateEstablished {
+		p.IBGP = true
+	}
+	return p
 }
 
 /*
@@ -356,13 +1642,12 @@ func (b *BGP) sendKeepalive() {
 	}
 	msg, err := marshalMessageHeader(msgTypeKeepAlive, 0)
 	if err != nil {
-		fmt.Println("sendKeepalive:", err)
+		b.reportError("sendKeepalive", err)
 		return
 	}
 	b.debug("%s: Sending a KEEPALIVE message", b.peer)
-	if _, err := b.conn.Write(msg); err != nil {
-		fmt.Println("sendKeepalive:", err)
-		b.disconnect()
+	if err := b.write(msg); err != nil {
+		b.reportError("sendKeepalive", err)
 	}
 }
 
@@ -370,38 +1655,80 @@ func (b *BGP) sendKeepalive() {
 	Read messages from the BGP peer
 */
 func (b *BGP) readReply() {
-	buf := make([]byte, 65536)
-	var msg message
 	for b.running {
-		if b.conn == nil {
-			fmt.Println("readReply: BGP connection NOT ready!")
-			time.Sleep(time.Second)
+		b.mu.Lock()
+		c, gen := b.conn, b.connGen
+		b.mu.Unlock()
+		if c == nil {
+			b.reportError("readReply", errors.New("BGP connection NOT ready!"))
+			if !b.sleep(time.Second) {
+				return
+			}
 			continue
 		}
-		n, err := b.conn.Read(buf)
-		if err != nil {
-			fmt.Println("readReply:", err)
-			b.disconnect()
-			time.Sleep(500 * time.Millisecond)
-			continue
+		in, err := readFrame(c, b.sessionParams().maxLength())
+		if err == nil {
+			b.holdTimer.Reset()
 		}
-		if n < headerLength {
-			fmt.Println("readReply: Too small packet!")
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				/*
+					Connection closed by the peer or by us, not an error
+				*/
+				b.debug("%s: readReply: Connection closed", b.peer)
+			} else {
+				b.reportError("readReply", err)
+			}
+			var ne *notificationError
+			if errors.As(err, &ne) {
+				if err := b.sendNotification(ne.msg.Code, ne.msg.SubCode, ne.msg.Data); err != nil {
+					b.reportError("readReply", err)
+				}
+			}
+			/*
+				The connection closed by us is already disconnected
+			*/
+			if !errors.Is(err, net.ErrClosed) {
+				b.disconnect(err.Error())
+			}
+			if !b.sleep(500 * time.Millisecond) {
+				return
+			}
 			continue
 		}
-		pkts := bytes.Split(buf[:n], headerMarker)
-		if len(pkts) < 2 {
-			fmt.Println("readReply: Invalid packet")
+		msg, err := unmarshalMessage(in, b.sessionParams())
+		if err != nil {
+			b.reportError("readReply", err)
+			var ne *notificationError
+			if errors.As(err, &ne) {
+				if err := b.sendNotification(ne.msg.Code, ne.msg.SubCode, ne.msg.Data); err != nil {
+					b.reportError("readReply", err)
+				}
+				b.disconnect(err.Error())
+			}
 			continue
 		}
-		for _, v := range pkts[1:] {
-			msg, err = unmarshalMessage(v)
-			if err != nil {
-				fmt.Println("readReply:", err)
-				continue
+		msg.gen = gen
+		b.chMu.Lock()
+		if b.running {
+			select {
+			case b.ch <- msg:
+			case <-b.stopping:
 			}
-			b.ch <- msg
 		}
+		b.chMu.Unlock()
+	}
+}
+
+/*
+	Wait for the duration, false if the instance is stopped in the meantime
+*/
+func (b *BGP) sleep(d time.Duration) bool {
+	select {
+	case <-b.clock.After(d):
+		return true
+	case <-b.stopping:
+		return false
 	}
 }
 
@@ -409,52 +1736,222 @@ func (b *BGP) readReply() {
 	Process messages received from the BGP peer
 */
 func (b *BGP) processReply() {
+	defer close(b.processed)
 	for m := range b.ch {
+		b.mu.Lock()
+		stale := m.gen != b.connGen
+		b.mu.Unlock()
+		if stale {
+			b.debug("%s: processReply: Dropping a message of the previous connection", b.peer)
+			continue
+		}
 		switch m.Type {
 		case msgTypeOpen:
 			b.debug("%s: processReply: Got an OPEN message", b.peer)
-			go b.sendKeepalive()
+			o := m.Data.(msgOpen)
+			if o.HoldTime > 0 && o.HoldTime < 3 {
+				b.reportError(b.peer+": processReply", fmt.Errorf("Unacceptable hold time %d", o.HoldTime))
+				// OPEN Message Error, Unacceptable Hold Time
+				if err := b.sendNotification(2, 6, ""); err != nil {
+					b.reportError("processReply", err)
+				}
+				b.disconnect("Unacceptable hold time")
+				continue
+			}
+			if missing := o.missingCapabilities(b.capabilities()); len(missing) > 0 {
+				b.reportError(b.peer+": processReply", fmt.Errorf("Required capabilities not supported %v", missing))
+				// OPEN Message Error, Unsupported Capability
+				if err := b.sendNotification(2, 7, string(marshalCapabilities(missing))); err != nil {
+					b.reportError("processReply", err)
+				}
+				b.disconnect("Required capabilities not supported")
+				continue
+			}
+			b.mu.Lock()
+			b.peerAS = o.ASN
+			b.peerHold = o.HoldTime
+			b.peerID = o.RouterID
+			if o.HoldTime < b.hold {
+				b.negotiatedHold = o.HoldTime
+			}
+			b.params.AS4 = b.as > 0xffff && o.hasCapability(capabilityFourOctetAS)
+			b.params.ExtendedMessage = b.extendedMessages && o.hasCapability(capabilityExtendedMessage)
+			b.params.MPReach = b.multiprotocolIPv4 && o.hasMultiprotocol(afiIPv4, safiUnicast)
+			b.params.FlowSpec = b.flowSpec && o.hasMultiprotocol(afiIPv4, safiFlowSpec)
+			b.params.AddPath = b.addPath && o.addPathMode(afiIPv4, safiUnicast)&addPathReceive != 0
+			b.params.IBGP = o.ASN == b.as
+			if !b.params.IBGP && !b.disableASPrepend {
+				b.params.PrependAS = b.as
+			}
+			hold := b.negotiatedHold
+			b.mu.Unlock()
+			b.startSessionTimers(hold)
+			b.setState(StateOpenConfirm, "OPEN message received")
+			/*
+				Sent before processing the next message, the peer has to see
+				it before the first UPDATE message
+			*/
+			b.sendKeepalive()
 		case msgTypeUpdate:
 			b.debug("%s: processReply: Got an UPDATE message", b.peer)
-			b.updateHandler(m.Data.(MsgUpdate))
+			if s := b.State(); s != StateEstablished {
+				b.reportError(b.peer+": processReply", fmt.Errorf("UPDATE message received in the %s state", s))
+				if err := b.sendNotification(5, fsmErrorSubCode(s), ""); err != nil {
+					b.reportError("processReply", err)
+				}
+				b.disconnect("UPDATE message received in the " + s.String() + " state")
+				continue
+			}
+			u := m.Data.(MsgUpdate)
+			if l := len(u.AsPath.Path) + len(u.AsPath.Set); uint(l) > b.maxASPathLength {
+				b.reportError(b.peer+": processReply", fmt.Errorf("AS path too long (%d)", l))
+				// UPDATE Message Error, Malformed AS_PATH
+				if err := b.sendNotification(3, 11, ""); err != nil {
+					b.reportError("processReply", err)
+				}
+				b.disconnect("AS path too long")
+				continue
+			}
+			if b.PeerAS() != b.as && len(u.Prefixes) > 0 && b.isLooped(u.AsPath) {
+				b.debug("%s: processReply: Dropping looped prefixes %v", b.peer, u.Prefixes)
+				b.mu.Lock()
+				b.stats.LoopedPrefixes += uint64(len(u.Prefixes))
+				b.mu.Unlock()
+				u.Prefixes = nil
+				if len(u.Withdrawns) == 0 {
+					continue
+				}
+			}
+			b.importUpdate(u)
+			b.checkPrefixLimit()
 		case msgTypeNotification:
 			b.debug("%s: processReply: Got a NOTIFICATION message", b.peer)
-			x, err := parseNotificationMessage(m.Data.(msgNotification))
+			n := m.Data.(msgNotification)
+			x, err := parseNotificationMessage(n)
 			if err != nil {
-				fmt.Println(err)
+				b.reportError("processReply", err)
 			} else {
 				fmt.Println(x)
+				b.emit(Event{Type: EventNotification, Notification: x})
+			}
+			if n.isShutdown() && b.onPeerShutdown != nil {
+				b.onPeerShutdown(n.shutdownMessage())
+			}
+			if b.continueOnNotification {
+				b.debug("%s: processReply: Keeping the session after the NOTIFICATION message", b.peer)
+				continue
 			}
-			b.disconnect()
+			b.disconnect("NOTIFICATION message received")
 		case msgTypeKeepAlive:
 			b.debug("%s: processReply: Got a KEEPALIVE message", b.peer)
-		default:
-			fmt.Printf("%s: processReply: BUG BUG BUG\n", b.peer)
+			if b.State() == StateOpenConfirm {
+				b.setState(StateEstablished, "KEEPALIVE message received")
+				b.spawn(b.synchronize)
+			}
+		}
+	}
+}
+
+/*
+	Check whether the AS path contains the local AS number more times than allowed
+*/
+func (b *BGP) isLooped(p TypeAsPath) bool {
+	var n uint
+	for _, v := range append(p.Path, p.Set...) {
+		if v == b.as {
+			n++
 		}
 	}
+	return n > b.allowOwnAS
 }
 
 /*
 	Send UPDATE message to the BGP peer
 */
-func (b *BGP) sendUpdate(m MsgUpdate) (err error) {
-	if b.conn == nil {
-		err = fmt.Errorf("sendUpdate: BGP connection NOT ready!")
+func (b *BGP) writeUpdate(m MsgUpdate) (err error) {
+	if b.State() != StateEstablished {
+		/*
+			The internal database is sent once the session is Established
+		*/
+		b.debug("%s: Session not established, UPDATE message deferred", b.peer)
+		return
+	}
+
+	m, suppressed := b.suppress(m)
+	if suppressed {
+		b.debug("%s: UPDATE message suppressed", b.peer)
 		return
 	}
 
-	msg, err := marshalMessageUpdate(m)
+	m, ok := b.applyExportPolicy(m)
+	if !ok {
+		b.debug("%s: UPDATE message rejected by the export policy", b.peer)
+		return
+	}
+	m = b.drainUpdate(m)
+	m = b.gracefulShutdownUpdate(m)
+
+	msg, err := marshalMessageUpdate(m, b.sessionParams())
 	if err != nil {
 		return
 	}
 
 	b.debug("%s: Sending an UPDATE message", b.peer)
-	_, err = b.conn.Write(msg)
+	err = b.write(msg)
+	if err == nil {
+		b.keepaliveTimer.Reset()
+	}
+	return
+}
+
+/*
+	Send NOTIFICATION message to the BGP peer
+*/
+func (b *BGP) sendNotification(code, subcode uint8, data string) (err error) {
+	if b.conn == nil {
+		err = fmt.Errorf("sendNotification: BGP connection NOT ready!")
+		return
+	}
+
+	msg, err := marshalMessageNotification(msgNotification{Code: code, SubCode: subcode, Data: data})
+	if err != nil {
+		return
+	}
+
+	b.debug("%s: Sending a NOTIFICATION message", b.peer)
+	err = b.write(msg)
+	return
+}
+
+/*
+	Write the whole message to the BGP peer, the connection is closed on failure
+	including the expiration of the write timeout
+*/
+func (b *BGP) write(msg []byte) (err error) {
+	c := b.conn
+	if c == nil {
+		err = fmt.Errorf("write: BGP connection NOT ready!")
+		return
+	}
+
+	b.writeMu.Lock()
+	if d, ok := c.(writeDeadliner); ok {
+		err = d.SetWriteDeadline(b.clock.Now().Add(b.writeTimeout))
+	}
+	if err == nil {
+		err = writeFull(c, msg)
+	}
+	b.writeMu.Unlock()
+
+	if err != nil {
+		b.disconnect(err.Error())
+	}
+
 	return
 }
 
 func (b *BGP) debug(f string, a ...interface{}) {
 	if b.debugEnabled {
-		fmt.Printf(time.Now().Format(b.debugTimeFormat)+": "+f+"\n", a...)
+		fmt.Fprintf(b.debugOutput, b.clock.Now().Format(b.debugTimeFormat)+": "+f+"\n", a...)
 	}
 }
@@ -0,0 +1,49 @@
+package gobgp
+
+import (
+	"fmt"
+)
+
+/*
+	Advertise the prefix with the well-known BLACKHOLE community, RFC 7999,
+	and the discard next hop to have the traffic to it dropped by the peer.
+	The local AS is in the AS path only if not prepended automatically.
+*/
+func (b *BGP) Blackhole(prefix string) error {
+	var m MsgUpdate
+	m.Prefixes = []string{prefix}
+	m.Origin = OriginTypeIGP
+	m.AsPath = TypeAsPath{Type: AsPathTypeSequence}
+	if b.disableASPrepend {
+		m.AsPath.Path = []uint32{b.as}
+	}
+	m.NextHops = []string{b.blackholeNextHop}
+	m.Communities = []uint32{CommunityBlackhole}
+	return b.add(m)
+}
+
+/*
+	Withdraw the prefix advertised by Blackhole
+*/
+func (b *BGP) Unblackhole(prefix string) error {
+	m, ok := b.Get(prefix)
+	if !ok {
+		return fmt.Errorf("Unblackhole: Prefix %s not found", prefix)
+	}
+	if !hasCommunity(m.Communities, CommunityBlackhole) {
+		return fmt.Errorf("Unblackhole: Prefix %s is not blackholed", prefix)
+	}
+	return b.Del(prefix)
+}
+
+/*
+	Check whether the community is in the list
+*/
+func hasCommunity(list []uint32, c uint32) bool {
+	for _, v := range list {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,27 @@
+package gobgp
+
+import (
+	"time"
+)
+
+/*
+	Source of time used by the timers, allows to drive the timers
+	by a fake clock in tests
+*/
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+/*
+	Clock backed by the system time
+*/
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -0,0 +1,616 @@
+package gobgp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+	Hold time while waiting for the OPEN message of the peer, RFC 4271 section 8
+*/
+const collectorOpenHoldTime = 4 * time.Minute
+
+/*
+	Passive BGP speaker accepting sessions from multiple peers and collecting
+	their routes, nothing is advertised to the peers
+*/
+type Collector struct {
+	/*
+		Router ID
+	*/
+	id string
+
+	/*
+		Local AS number
+	*/
+	as uint32
+
+	/*
+		Hold time in seconds
+	*/
+	hold uint16
+
+	/*
+		Local address:port to listen on
+	*/
+	address string
+
+	/*
+		Transport carrying the BGP sessions
+	*/
+	transport Transport
+
+	/*
+		Listener of the transport
+	*/
+	listener Listener
+
+	/*
+		Is the collector accepting sessions?
+	*/
+	running bool
+
+	/*
+		Advertise support of extended messages
+	*/
+	extendedMessages bool
+
+	/*
+		Advertise the multiprotocol capability for IPv4 unicast
+	*/
+	multiprotocolIPv4 bool
+
+	/*
+		Advertise the multiprotocol capability for IPv4 flow specification
+	*/
+	flowSpec bool
+
+	/*
+		Additional capabilities advertised in the OPEN message
+	*/
+	extraCapabilities []Capability
+
+	/*
+		Refuse unrecognized well-known attributes
+	*/
+	strictAttributes bool
+
+	/*
+		Maximum number of concurrent sessions, unlimited if zero
+	*/
+	maxSessions int
+
+	/*
+		Maximum number of prefixes received per session, unlimited if zero
+	*/
+	maxPrefixes uint32
+
+	/*
+		Write timeout of the sessions
+	*/
+	writeTimeout time.Duration
+
+	/*
+		Source of time for the timers
+	*/
+	clock Clock
+
+	/*
+		Established sessions indexed by the peer address
+	*/
+	sessions map[string]*collectorSession
+
+	/*
+		Guards the sessions and the listener
+	*/
+	mu sync.Mutex
+
+	/*
+		Enabled / disabled debugging messages
+	*/
+	debugEnabled bool
+
+	/*
+		Datetime prefix for debug messages
+	*/
+	debugTimeFormat string
+
+	/*
+		Destination of debugging messages
+	*/
+	debugOutput io.Writer
+
+	/*
+		Application defined function for handling update messages
+	*/
+	updateHandler func(peer string, m MsgUpdate)
+}
+
+/*
+	Single inbound session of the collector
+*/
+type collectorSession struct {
+	/*
+		Address of the peer
+	*/
+	peer string
+
+	/*
+		Underlying transport connection
+	*/
+	conn io.ReadWriteCloser
+
+	/*
+		Parameters negotiated for the session
+	*/
+	params sessionParams
+
+	/*
+		Serializes writes to the connection
+	*/
+	mu sync.Mutex
+
+	/*
+		Closed when the session terminates
+	*/
+	done chan struct{}
+
+	/*
+		Source of time for the timers
+	*/
+	clock Clock
+
+	/*
+		Write timeout of the connection
+	*/
+	writeTimeout time.Duration
+
+	/*
+		State of the session, changed by the serving goroutine only
+	*/
+	state State
+
+	/*
+		Closes the session when no message is received within the hold time
+	*/
+	holdTimer *fsmTimer
+
+	/*
+		Prefixes currently announced by the peer
+	*/
+	prefixes map[string]bool
+}
+
+/*
+	Create a new route collector, the Peer in the configuration is not used
+	and the collector listens on the LocalAddress (all addresses if empty).
+	The zero HoldTime is advertised as it is, RFC 4271, the sessions then
+	run without KEEPALIVE messages and without the hold timer.
+*/
+func NewCollector(c BgpConfig, uf func(peer string, m MsgUpdate)) (*Collector, error) {
+	var r Collector
+
+	r.debugEnabled = c.DebugEnabled
+	r.debugOutput = os.Stdout
+	if len(c.DebugTimeFormat) > 0 {
+		r.debugTimeFormat = c.DebugTimeFormat
+	} else {
+		r.debugTimeFormat = defaultDebugTimeFormat
+	}
+
+	if c.Clock != nil {
+		r.clock = c.Clock
+	} else {
+		r.clock = realClock{}
+	}
+
+	/*
+		Validate the configuration, the peer is not used
+	*/
+	if err := errors.Join(c.validateSpeaker()...); err != nil {
+		return &r, fmt.Errorf("NewCollector: %w", err)
+	}
+
+	r.address = net.JoinHostPort(c.LocalAddress, strconv.Itoa(int(c.port())))
+
+	if c.Transport != nil {
+		r.transport = c.Transport
+	} else {
+		r.transport = TCPTransport{LocalAddress: c.LocalAddress}
+	}
+	if c.TLSConfig != nil {
+		r.transport = TLSTransport{Transport: r.transport, Config: c.TLSConfig}
+	}
+
+	/*
+		Set Router ID, derive it if not specified
+	*/
+	if len(c.RouterID) == 0 {
+		id, err := deriveRouterID(net.ParseIP(c.LocalAddress))
+		if err != nil {
+			return &r, fmt.Errorf("NewCollector: %v", err)
+		}
+		r.debug("NewCollector: Using derived Router ID %s", id)
+		c.RouterID = id
+	}
+	r.id = c.RouterID
+
+	r.as = c.ASN
+	r.hold = c.HoldTime
+	r.extendedMessages = c.ExtendedMessages
+	r.multiprotocolIPv4 = c.MultiprotocolIPv4
+	r.flowSpec = c.FlowSpec
+	r.extraCapabilities = c.Capabilities
+	r.strictAttributes = c.StrictAttributes
+	r.maxSessions = c.MaxSessions
+	r.maxPrefixes = c.MaxPrefixes
+
+	/*
+		Set write timeout
+	*/
+	if c.WriteTimeout > 0 {
+		// Application specified
+		r.writeTimeout = c.WriteTimeout
+	} else {
+		// Hardcoded default
+		r.writeTimeout = defaultWriteTimeout
+	}
+
+	r.sessions = make(map[string]*collectorSession)
+
+	if uf != nil {
+		r.updateHandler = uf
+	} else {
+		r.updateHandler = func(peer string, m MsgUpdate) {}
+	}
+
+	return &r, nil
+}
+
+/*
+	Listen for inbound BGP sessions and serve them until Close is called
+*/
+func (r *Collector) ListenAndServe() error {
+	r.mu.Lock()
+	if r.running {
+		r.mu.Unlock()
+		return fmt.Errorf("ListenAndServe: Alredy running")
+	}
+	l, err := r.transport.Listen(r.address)
+	if err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	r.listener = l
+	r.running = true
+	r.mu.Unlock()
+
+	r.debug("%s: Listening", r.address)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			r.mu.Lock()
+			running := r.running
+			r.mu.Unlock()
+			if !running {
+				return nil
+			}
+			return err
+		}
+		go r.serve(conn)
+	}
+}
+
+/*
+	Stop accepting sessions and close all established ones
+*/
+func (r *Collector) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.running {
+		return fmt.Errorf("Close: Not running")
+	}
+	r.running = false
+	for _, v := range r.sessions {
+		v.conn.Close()
+	}
+	return r.listener.Close()
+}
+
+/*
+	Run the BGP session of a single accepted connection
+*/
+func (r *Collector) serve(conn io.ReadWriteCloser) {
+	s := &collectorSession{conn: conn, done: make(chan struct{}), clock: r.clock, writeTimeout: r.writeTimeout, state: StateOpenSent, prefixes: make(map[string]bool)}
+	s.params.StrictAttributes = r.strictAttributes
+	s.peer = remoteAddress(conn)
+
+	r.mu.Lock()
+	if _, e := r.sessions[s.peer]; e {
+		r.mu.Unlock()
+		fmt.Printf("%s: serve: Session alredy exists\n", s.peer)
+		conn.Close()
+		return
+	}
+	if r.maxSessions > 0 && len(r.sessions) >= r.maxSessions {
+		r.mu.Unlock()
+		fmt.Printf("%s: serve: Maximum number of sessions %d reached\n", s.peer, r.maxSessions)
+		// Cease, Connection Rejected
+		if err := s.sendNotification(msgNotification{Code: 6, SubCode: 5}); err != nil {
+			fmt.Printf("%s: serve: %v\n", s.peer, err)
+		}
+		conn.Close()
+		return
+	}
+	r.sessions[s.peer] = s
+	r.mu.Unlock()
+
+	defer func() {
+		close(s.done)
+		conn.Close()
+		r.mu.Lock()
+		delete(r.sessions, s.peer)
+		r.mu.Unlock()
+		r.debug("%s: Session closed", s.peer)
+	}()
+
+	r.debug("%s: Accepted connection", s.peer)
+
+	var caps []Capability
+	if r.extendedMessages {
+		caps = append(caps, Capability{Code: capabilityExtendedMessage})
+	}
+	if r.multiprotocolIPv4 {
+		caps = append(caps, multiprotocolCapability(afiIPv4, safiUnicast))
+	}
+	if r.flowSpec {
+		caps = append(caps, multiprotocolCapability(afiIPv4, safiFlowSpec))
+	}
+	for _, v := range r.extraCapabilities {
+		caps = appendCapability(caps, v)
+	}
+	msg, err := marshalMessageOpen(msgOpen{ASN: r.as, HoldTime: r.hold, RouterID: r.id, Capabilities: caps})
+	if err != nil {
+		fmt.Println("serve:", err)
+		return
+	}
+	r.debug("%s: Sending an OPEN message", s.peer)
+	if err := s.write(msg); err != nil {
+		fmt.Println("serve:", err)
+		return
+	}
+
+	s.holdTimer = newFSMTimer(s.clock, collectorOpenHoldTime)
+	go s.holdWatchdog()
+
+	for {
+		in, err := readFrame(conn, s.params.maxLength())
+		if err != nil {
+			r.debug("%s: serve: %v", s.peer, err)
+			var ne *notificationError
+			if errors.As(err, &ne) {
+				s.sendNotification(ne.msg)
+			}
+			return
+		}
+		s.holdTimer.Reset()
+		m, err := unmarshalMessage(in, s.params)
+		if err != nil {
+			fmt.Printf("%s: serve: %v\n", s.peer, err)
+			var ne *notificationError
+			if errors.As(err, &ne) {
+				s.sendNotification(ne.msg)
+				return
+			}
+			continue
+		}
+
+		switch m.Type {
+		case msgTypeOpen:
+			r.debug("%s: serve: Got an OPEN message", s.peer)
+			if s.state != StateOpenSent {
+				fmt.Printf("%s: serve: OPEN message received in the %s state\n", s.peer, s.state)
+				if err := s.sendNotification(msgNotification{Code: 5, SubCode: fsmErrorSubCode(s.state)}); err != nil {
+					fmt.Printf("%s: serve: %v\n", s.peer, err)
+				}
+				return
+			}
+			o := m.Data.(msgOpen)
+			if o.HoldTime > 0 && o.HoldTime < 3 {
+				fmt.Printf("%s: serve: Unacceptable hold time %d\n", s.peer, o.HoldTime)
+				// OPEN Message Error, Unacceptable Hold Time
+				if err := s.sendNotification(msgNotification{Code: 2, SubCode: 6}); err != nil {
+					fmt.Printf("%s: serve: %v\n", s.peer, err)
+				}
+				return
+			}
+			if missing := o.missingCapabilities(caps); len(missing) > 0 {
+				fmt.Printf("%s: serve: Required capabilities not supported %v\n", s.peer, missing)
+				// OPEN Message Error, Unsupported Capability
+				if err := s.sendNotification(msgNotification{Code: 2, SubCode: 7, Data: string(marshalCapabilities(missing))}); err != nil {
+					fmt.Printf("%s: serve: %v\n", s.peer, err)
+				}
+				return
+			}
+			h := o.HoldTime
+			if r.hold < h {
+				h = r.hold
+			}
+			s.params.AS4 = r.as > 0xffff && o.hasCapability(capabilityFourOctetAS)
+			s.params.ExtendedMessage = r.extendedMessages && o.hasCapability(capabilityExtendedMessage)
+			s.params.MPReach = r.multiprotocolIPv4 && o.hasMultiprotocol(afiIPv4, safiUnicast)
+			if err := s.sendKeepalive(); err != nil {
+				fmt.Printf("%s: serve: %v\n", s.peer, err)
+				return
+			}
+			s.state = StateOpenConfirm
+			s.holdTimer.Set(time.Duration(h) * time.Second)
+			/*
+				No KEEPALIVE messages are sent if the negotiated
+				hold time is zero
+			*/
+			if h > 0 {
+				go s.keepalive(h)
+			}
+		case msgTypeUpdate:
+			r.debug("%s: serve: Got an UPDATE message", s.peer)
+			if s.state != StateEstablished {
+				fmt.Printf("%s: serve: UPDATE message received in the %s state\n", s.peer, s.state)
+				if err := s.sendNotification(msgNotification{Code: 5, SubCode: fsmErrorSubCode(s.state)}); err != nil {
+					fmt.Printf("%s: serve: %v\n", s.peer, err)
+				}
+				return
+			}
+			u := m.Data.(MsgUpdate)
+			if !s.countPrefixes(u, r.maxPrefixes) {
+				return
+			}
+			r.updateHandler(s.peer, u)
+		case msgTypeNotification:
+			r.debug("%s: serve: Got a NOTIFICATION message", s.peer)
+			x, err := parseNotificationMessage(m.Data.(msgNotification))
+			if err != nil {
+				fmt.Println(err)
+			} else {
+				fmt.Printf("%s: %s\n", s.peer, x)
+			}
+			return
+		case msgTypeKeepAlive:
+			r.debug("%s: serve: Got a KEEPALIVE message", s.peer)
+			if s.state == StateOpenConfirm {
+				s.state = StateEstablished
+			}
+		}
+	}
+}
+
+/*
+	Return the number of established sessions
+*/
+func (r *Collector) Sessions() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions)
+}
+
+/*
+	Track the prefixes announced by the peer, false if the limit is exceeded
+	and the session is closed by the Maximum Number of Prefixes Reached
+	notification
+*/
+func (s *collectorSession) countPrefixes(u MsgUpdate, limit uint32) bool {
+	for _, p := range u.Withdrawns {
+		delete(s.prefixes, p)
+	}
+	for _, p := range u.Prefixes {
+		s.prefixes[p] = true
+	}
+	if limit == 0 || uint32(len(s.prefixes)) <= limit {
+		return true
+	}
+
+	fmt.Printf("%s: serve: Maximum number of prefixes %d exceeded\n", s.peer, limit)
+	// Cease, Maximum Number of Prefixes Reached
+	if err := s.sendNotification(msgNotification{Code: 6, SubCode: 1, Data: maxPrefixesData(limit)}); err != nil {
+		fmt.Printf("%s: serve: %v\n", s.peer, err)
+	}
+	return false
+}
+
+/*
+	Periodically send KEEPALIVE message at interval 1/3 of the negotiated HOLDTIME
+*/
+func (s *collectorSession) keepalive(hold uint16) {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.clock.After(time.Duration(hold/3) * time.Second):
+		}
+		if err := s.sendKeepalive(); err != nil {
+			fmt.Printf("%s: keepalive: %v\n", s.peer, err)
+			s.conn.Close()
+			return
+		}
+	}
+}
+
+/*
+	Close the session by the Hold Timer Expired notification when no message
+	was received from the peer within the hold time
+*/
+func (s *collectorSession) holdWatchdog() {
+	if !s.holdTimer.Wait(s.done) {
+		return
+	}
+	fmt.Printf("%s: holdWatchdog: Hold timer expired\n", s.peer)
+	// Hold Timer Expired
+	if err := s.sendNotification(msgNotification{Code: 4}); err != nil {
+		fmt.Printf("%s: holdWatchdog: %v\n", s.peer, err)
+	}
+	s.conn.Close()
+}
+
+/*
+	Send a KEEPALIVE message to the peer
+*/
+func (s *collectorSession) sendKeepalive() error {
+	msg, err := marshalMessageHeader(msgTypeKeepAlive, 0)
+	if err != nil {
+		return err
+	}
+	return s.write(msg)
+}
+
+/*
+	Send a NOTIFICATION message to the peer
+*/
+func (s *collectorSession) sendNotification(n msgNotification) error {
+	msg, err := marshalMessageNotification(n)
+	if err != nil {
+		return err
+	}
+	return s.write(msg)
+}
+
+/*
+	Write the message to the peer, the connection is closed on the expiration
+	of the write timeout
+*/
+func (s *collectorSession) write(msg []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d, ok := s.conn.(writeDeadliner); ok {
+		if err := d.SetWriteDeadline(s.clock.Now().Add(s.writeTimeout)); err != nil {
+			s.conn.Close()
+			return err
+		}
+	}
+	if err := writeFull(s.conn, msg); err != nil {
+		s.conn.Close()
+		return err
+	}
+	return nil
+}
+
+/*
+	Redirect debugging messages to the writer, standard output if nil
+*/
+func (r *Collector) SetDebugOutput(w io.Writer) {
+	if w == nil {
+		w = os.Stdout
+	}
+	r.debugOutput = w
+}
+
+func (r *Collector) debug(f string, a ...interface{}) {
+	if r.debugEnabled {
+		fmt.Fprintf(r.debugOutput, r.clock.Now().Format(r.debugTimeFormat)+": "+f+"\n", a...)
+	}
+}
@@ -0,0 +1,119 @@
+package gobgp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+/*
+	Configuration validation errors
+*/
+var (
+	ErrInvalidLocalAddress = errors.New("Invalid local address")
+	ErrInvalidRouterID     = errors.New("Invalid Router ID")
+	ErrInvalidASN          = errors.New("Invalid AS number")
+	ErrHoldTimeTooSmall    = errors.New("Hold time too small")
+	ErrInvalidPeerAddress  = errors.New("Invalid peer IP address")
+	ErrInvalidDamping      = errors.New("Invalid damping parameters")
+	ErrInvalidNextHop      = errors.New("Invalid next hop")
+	ErrLocalPeer           = errors.New("Peer address is local")
+	ErrInvalidThreshold    = errors.New("Invalid prefix threshold")
+	ErrMartianPrefix       = errors.New("Martian prefix")
+)
+
+/*
+	Validate the configuration without creating the BGP instance,
+	all found problems are returned joined together
+*/
+func (c BgpConfig) Validate() error {
+	errs := c.validateSpeaker()
+
+	/*
+		Validate peer IP address
+	*/
+	if _, err := parsePeerAddress(c.Peer); err != nil {
+		errs = append(errs, fmt.Errorf("%w: %v", ErrInvalidPeerAddress, err))
+	}
+
+	/*
+		Validate next hop of the blackholed prefixes
+	*/
+	if len(c.BlackholeNextHop) > 0 && net.ParseIP(c.BlackholeNextHop).To4() == nil {
+		errs = append(errs, ErrInvalidNextHop)
+	}
+
+	return errors.Join(errs...)
+}
+
+/*
+	Return the TCP port of the BGP sessions
+*/
+func (c BgpConfig) port() uint16 {
+	if c.Port > 0 {
+		// Application specified
+		return c.Port
+	}
+	// Hardcoded default
+	return bgpPort
+}
+
+/*
+	Validate the configuration of the local BGP speaker
+*/
+func (c BgpConfig) validateSpeaker() (errs []error) {
+	/*
+		Validate local address, the source of the TCP session
+	*/
+	if len(c.LocalAddress) > 0 {
+		if a := net.ParseIP(c.LocalAddress); a == nil || a.IsMulticast() {
+			errs = append(errs, ErrInvalidLocalAddress)
+		}
+	}
+
+	/*
+		Validate Router ID, it is derived later if not specified, the BGP
+		identifier must be a non-zero unicast IPv4 address
+	*/
+	if len(c.RouterID) > 0 {
+		if a := net.ParseIP(c.RouterID).To4(); a == nil || a.IsUnspecified() || a.IsMulticast() || a.Equal(net.IPv4bcast) {
+			errs = append(errs, ErrInvalidRouterID)
+		}
+	}
+
+	/*
+		Validate AS number
+	*/
+	if c.ASN == 0 {
+		errs = append(errs, ErrInvalidASN)
+	}
+
+	/*
+		Validate hold time
+	*/
+	if c.HoldTime > 0 && c.HoldTime < 3 {
+		errs = append(errs, ErrHoldTimeTooSmall)
+	}
+
+	/*
+		Validate damping parameters
+	*/
+	if c.Damping != nil {
+		d := c.Damping.withDefaults()
+		if d.Suppress < 0 || d.Reuse < 0 || d.Reuse >= d.Suppress || d.HalfLife < 0 || d.MaxSuppress < 0 {
+			errs = append(errs, ErrInvalidDamping)
+		}
+	}
+
+	/*
+		Validate prefix thresholds, in percent of the limit
+	*/
+	for _, v := range c.PrefixThresholds {
+		if v < 1 || v > 100 || c.MaxPrefixes == 0 {
+			errs = append(errs, ErrInvalidThreshold)
+			break
+		}
+	}
+
+	return
+}
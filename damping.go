@@ -0,0 +1,203 @@
+package gobgp
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	/*
+		Penalties of a single flap, RFC 2439
+	*/
+	dampingWithdrawPenalty  = 1000
+	dampingAttributePenalty = 500
+
+	/*
+		Defaults of the damping parameters
+	*/
+	defaultDampingHalfLife    = 15 * time.Minute
+	defaultDampingSuppress    = 2000
+	defaultDampingReuse       = 750
+	defaultDampingMaxSuppress = 60 * time.Minute
+
+	/*
+		How often the suppressed routes are checked for reuse
+	*/
+	dampingReuseInterval = 5 * time.Second
+)
+
+/*
+	Parameters of the route flap damping, RFC 2439, zero values are replaced
+	by the defaults
+*/
+type Damping struct {
+	/*
+		Penalty above which the route is suppressed, default 2000
+	*/
+	Suppress float64
+
+	/*
+		Penalty below which the suppressed route is used again, default 750
+	*/
+	Reuse float64
+
+	/*
+		Time after which the penalty decays to half, default 15 minutes
+	*/
+	HalfLife time.Duration
+
+	/*
+		Maximum time the route can be suppressed, default 60 minutes
+	*/
+	MaxSuppress time.Duration
+}
+
+/*
+	Penalty bookkeeping of a single prefix
+*/
+type dampState struct {
+	penalty    float64
+	updated    time.Time
+	suppressed bool
+}
+
+/*
+	Return the parameters with the defaults filled in
+*/
+func (d Damping) withDefaults() Damping {
+	if d.Suppress == 0 {
+		d.Suppress = defaultDampingSuppress
+	}
+	if d.Reuse == 0 {
+		d.Reuse = defaultDampingReuse
+	}
+	if d.HalfLife == 0 {
+		d.HalfLife = defaultDampingHalfLife
+	}
+	if d.MaxSuppress == 0 {
+		d.MaxSuppress = defaultDampingMaxSuppress
+	}
+	return d
+}
+
+/*
+	Maximum penalty, the route is reused at latest after MaxSuppress
+*/
+func (d Damping) ceiling() float64 {
+	return d.Reuse * math.Pow(2, float64(d.MaxSuppress)/float64(d.HalfLife))
+}
+
+/*
+	Decay the penalty to the time
+*/
+func (s *dampState) decay(d Damping, now time.Time) {
+	if t := now.Sub(s.updated); t > 0 {
+		s.penalty *= math.Pow(0.5, float64(t)/float64(d.HalfLife))
+	}
+	s.updated = now
+}
+
+/*
+	Charge the prefix with the penalty of a flap and return whether it is
+	suppressed, must be called with the lock held
+*/
+func (b *BGP) dampFlap(p string, penalty float64) bool {
+	if b.damping == nil {
+		return false
+	}
+
+	now := b.clock.Now()
+	s, ok := b.damped[p]
+	if !ok {
+		s = &dampState{updated: now}
+		b.damped[p] = s
+	}
+	s.decay(*b.damping, now)
+	s.penalty = math.Min(s.penalty+penalty, b.damping.ceiling())
+
+	if !s.suppressed && s.penalty >= b.damping.Suppress {
+		s.suppressed = true
+		b.debug("%s: Prefix %s suppressed, penalty %.0f", b.peer, p, s.penalty)
+	}
+
+	return s.suppressed
+}
+
+/*
+	Return whether the prefix is suppressed, must be called with the lock held
+*/
+func (b *BGP) isSuppressed(p string) bool {
+	s, ok := b.damped[p]
+	return ok && s.suppressed
+}
+
+/*
+	Periodically release the suppressed routes whose penalty decayed
+*/
+func (b *BGP) dampingReuse() {
+	for b.sleep(dampingReuseInterval) {
+		b.reuseDamped()
+	}
+}
+
+/*
+	Pass the routes whose penalty decayed below the reuse threshold
+	to the update handler and forget the stable prefixes
+*/
+func (b *BGP) reuseDamped() {
+	b.mu.Lock()
+	policy := b.importPolicy
+	now := b.clock.Now()
+	var reused []MsgUpdate
+	for p, s := range b.damped {
+		s.decay(*b.damping, now)
+		if s.suppressed && s.penalty < b.damping.Reuse {
+			s.suppressed = false
+			b.debug("%s: Prefix %s reused", b.peer, p)
+			if m, ok := b.adjRibIn[p]; ok && !b.imported[p] {
+				reused = append(reused, m)
+			}
+		}
+		if !s.suppressed && s.penalty < b.damping.Reuse/2 {
+			delete(b.damped, p)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, m := range reused {
+		p := m.Prefixes[0]
+		if policy != nil && !policy(p, m) {
+			continue
+		}
+
+		b.mu.Lock()
+		if _, ok := b.adjRibIn[p]; !ok || b.imported[p] || b.isSuppressed(p) {
+			/*
+				Changed in the meantime
+			*/
+			b.mu.Unlock()
+			continue
+		}
+		m = b.adjRibIn[p]
+		b.imported[p] = true
+		b.mu.Unlock()
+
+		b.deliverUpdate(m)
+	}
+}
+
+/*
+	Return the received prefixes currently suppressed by the damping
+*/
+func (b *BGP) Suppressed() (ret []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for p, s := range b.damped {
+		if s.suppressed {
+			ret = append(ret, p)
+		}
+	}
+	sort.Strings(ret)
+	return
+}
@@ -0,0 +1,174 @@
+package gobgp
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+/*
+	Parameters of draining the traffic from the session before maintenance
+*/
+type DrainOptions struct {
+	/*
+		Number of times the local AS is prepended to the AS path,
+		eBGP peers only
+	*/
+	Prepend int
+
+	/*
+		Increase of the MED of all routes
+	*/
+	MEDIncrease uint32
+
+	/*
+		Withdraw all routes after the delay, the routes are kept if zero
+	*/
+	WithdrawAfter time.Duration
+}
+
+/*
+	Make the advertised routes less preferred by re-advertising them with
+	the worse attributes, the routes added later are drained as well.
+	The routes are optionally withdrawn after the delay, use Undrain
+	to return to the normal operation.
+*/
+func (b *BGP) Drain(o DrainOptions) error {
+	if o.Prepend < 0 {
+		return fmt.Errorf("Drain: Invalid number of prepends %d", o.Prepend)
+	}
+
+	b.mu.Lock()
+	if b.drain != nil {
+		b.mu.Unlock()
+		return fmt.Errorf("Drain: Alredy draining")
+	}
+	b.drain = &o
+	cancel := make(chan struct{})
+	b.drainCancel = cancel
+	b.mu.Unlock()
+
+	b.debug("%s: Draining, prepend %d times, MED increased by %d", b.peer, o.Prepend, o.MEDIncrease)
+	if b.State() == StateEstablished {
+		b.resendAll()
+	}
+
+	if o.WithdrawAfter > 0 {
+		go func() {
+			select {
+			case <-cancel:
+				return
+			case <-b.clock.After(o.WithdrawAfter):
+			}
+			if err := b.Pause(true); err != nil {
+				b.reportError("Drain", err)
+			}
+		}()
+	}
+
+	return nil
+}
+
+/*
+	Stop draining and re-advertise all routes with the original attributes
+*/
+func (b *BGP) Undrain() error {
+	b.mu.Lock()
+	if b.drain == nil {
+		b.mu.Unlock()
+		return fmt.Errorf("Undrain: Not draining")
+	}
+	withdrawn := b.drain.WithdrawAfter > 0 && b.paused
+	b.drain = nil
+	close(b.drainCancel)
+	b.drainCancel = nil
+	b.mu.Unlock()
+
+	b.debug("%s: Draining stopped", b.peer)
+	if withdrawn {
+		return b.Resume()
+	}
+	if b.State() == StateEstablished {
+		b.resendAll()
+	}
+	return nil
+}
+
+/*
+	Apply the draining to the announced routes of the update
+*/
+func (b *BGP) drainUpdate(m MsgUpdate) MsgUpdate {
+	b.mu.Lock()
+	d := b.drain
+	ibgp := b.params.IBGP
+	b.mu.Unlock()
+
+	if d == nil || len(m.Prefixes) == 0 {
+		return m
+	}
+	if !ibgp {
+		for i := 0; i < d.Prepend; i++ {
+			m.AsPath = m.AsPath.prepend(b.as)
+		}
+	}
+	if m.MED > math.MaxUint32-d.MEDIncrease {
+		m.MED = math.MaxUint32
+	} else {
+		m.MED += d.MEDIncrease
+	}
+	return m
+}
+
+/*
+	Re-advertise all routes with the GRACEFUL_SHUTDOWN community, RFC 8326,
+	the peers lower the preference of the routes before the session goes down
+*/
+func (b *BGP) GracefulShutdown() error {
+	b.mu.Lock()
+	if b.gracefulShutdown {
+		b.mu.Unlock()
+		return fmt.Errorf("GracefulShutdown: Alredy in graceful shutdown")
+	}
+	b.gracefulShutdown = true
+	b.mu.Unlock()
+
+	b.debug("%s: Graceful shutdown started", b.peer)
+	if b.State() == StateEstablished {
+		b.resendAll()
+	}
+	return nil
+}
+
+/*
+	Re-advertise all routes without the GRACEFUL_SHUTDOWN community
+*/
+func (b *BGP) EndGracefulShutdown() error {
+	b.mu.Lock()
+	if !b.gracefulShutdown {
+		b.mu.Unlock()
+		return fmt.Errorf("EndGracefulShutdown: Not in graceful shutdown")
+	}
+	b.gracefulShutdown = false
+	b.mu.Unlock()
+
+	b.debug("%s: Graceful shutdown ended", b.peer)
+	if b.State() == StateEstablished {
+		b.resendAll()
+	}
+	return nil
+}
+
+/*
+	Attach the GRACEFUL_SHUTDOWN community to the announced routes of the update
+*/
+func (b *BGP) gracefulShutdownUpdate(m MsgUpdate) MsgUpdate {
+	b.mu.Lock()
+	gs := b.gracefulShutdown
+	b.mu.Unlock()
+
+	if !gs || len(m.Prefixes) == 0 || hasCommunity(m.Communities, CommunityGracefulShutdown) {
+		return m
+	}
+	m.Communities = append(append([]uint32{}, m.Communities...), CommunityGracefulShutdown)
+	return m
+}
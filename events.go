@@ -0,0 +1,67 @@
+package gobgp
+
+/*
+	Types of events
+*/
+const (
+	_ = iota
+	EventUpdate
+	EventState
+	EventNotification
+	EventReconnect
+)
+
+/*
+	Event delivered to the application, only the field matching the type is set
+*/
+type Event struct {
+	/*
+		Type of the event
+	*/
+	Type uint
+
+	/*
+		Address of the peer
+	*/
+	Peer string
+
+	/*
+		Received update for EventUpdate
+	*/
+	Update MsgUpdate
+
+	/*
+		New state of the session for EventState
+	*/
+	State State
+
+	/*
+		Received notification for EventNotification
+	*/
+	Notification string
+}
+
+/*
+	Return the queue of events, nil unless enabled by EventQueueLength. Events are
+	dropped and counted in Stats when the queue is full.
+*/
+func (b *BGP) Events() <-chan Event {
+	return b.events
+}
+
+/*
+	Queue the event for the application without blocking
+*/
+func (b *BGP) emit(e Event) {
+	if b.events == nil {
+		return
+	}
+	e.Peer = b.peer
+	select {
+	case b.events <- e:
+	default:
+		b.mu.Lock()
+		b.stats.DroppedEvents++
+		b.mu.Unlock()
+	}
+}
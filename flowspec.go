@@ -0,0 +1,396 @@
+package gobgp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+)
+
+/*
+	Subsequent address family of the flow specification, RFC 8955
+*/
+const safiFlowSpec = 133
+
+/*
+	Types of flow specification components
+*/
+const (
+	flowSpecDestination     = 1
+	flowSpecSource          = 2
+	flowSpecProtocol        = 3
+	flowSpecDestinationPort = 5
+	flowSpecSourcePort      = 6
+)
+
+/*
+	Bits of the flow specification numeric operator
+*/
+const (
+	flowSpecOpEnd   = 0x80
+	flowSpecOpAnd   = 0x40
+	flowSpecOpLen   = 0x30
+	flowSpecOpEqual = 0x01
+)
+
+/*
+	Traffic rate action extended community, RFC 8955
+*/
+const extCommunityTrafficRate = 0x8006
+
+/*
+	Flow specification rule, RFC 8955. Empty match fields match any traffic,
+	multiple values of a single field match any of them. Only equality
+	matches of the numeric fields are supported.
+*/
+type FlowSpecRule struct {
+	/*
+		Destination IPv4 prefix
+	*/
+	Destination string
+
+	/*
+		Source IPv4 prefix
+	*/
+	Source string
+
+	/*
+		IP protocol numbers
+	*/
+	Protocols []uint8
+
+	/*
+		Destination ports
+	*/
+	DestinationPorts []uint16
+
+	/*
+		Source ports
+	*/
+	SourcePorts []uint16
+
+	/*
+		Limit the matching traffic to the rate in bytes per second
+	*/
+	RateLimit float32
+
+	/*
+		Drop the matching traffic, the rate limit of zero
+	*/
+	Discard bool
+}
+
+/*
+	Return the identification of the rule without the actions
+*/
+func (r FlowSpecRule) key() string {
+	r.RateLimit = 0
+	r.Discard = false
+	return fmt.Sprintf("%+v", r)
+}
+
+/*
+	Encode the rule into the flow specification NLRI
+*/
+func marshalFlowSpecNLRI(r FlowSpecRule) (ret []byte, err error) {
+	var buf []byte
+	for _, v := range []struct {
+		t uint8
+		p string
+	}{{flowSpecDestination, r.Destination}, {flowSpecSource, r.Source}} {
+		if len(v.p) == 0 {
+			continue
+		}
+		afi, n, m, e := parsePrefix(v.p)
+		if e != nil {
+			err = e
+			return
+		}
+		if afi != afiIPv4 {
+			err = fmt.Errorf("%w: %s", ErrUnsupportedAddressFamily, v.p)
+			return
+		}
+		buf = append(buf, v.t, m)
+		buf = append(buf, n[:(int(m)+7)/8]...)
+	}
+
+	var protocols []uint16
+	for _, v := range r.Protocols {
+		protocols = append(protocols, uint16(v))
+	}
+	buf = append(buf, marshalFlowSpecNumeric(flowSpecProtocol, protocols)...)
+	buf = append(buf, marshalFlowSpecNumeric(flowSpecDestinationPort, r.DestinationPorts)...)
+	buf = append(buf, marshalFlowSpecNumeric(flowSpecSourcePort, r.SourcePorts)...)
+
+	if len(buf) == 0 {
+		err = fmt.Errorf("Empty flow specification")
+		return
+	}
+
+	/*
+		Length of the NLRI in one octet, or in two octets below 4096
+	*/
+	switch {
+	case len(buf) < 240:
+		ret = []byte{byte(len(buf))}
+	case len(buf) < 4096:
+		ret = []byte{0xf0 | byte(len(buf)>>8), byte(len(buf))}
+	default:
+		err = fmt.Errorf("Flow specification too long")
+		return
+	}
+	ret = append(ret, buf...)
+
+	return
+}
+
+/*
+	Encode the numeric component matching any of the values
+*/
+func marshalFlowSpecNumeric(t uint8, values []uint16) (ret []byte) {
+	if len(values) == 0 {
+		return
+	}
+	ret = []byte{t}
+	for i, v := range values {
+		op := byte(flowSpecOpEqual)
+		if i == len(values)-1 {
+			op |= flowSpecOpEnd
+		}
+		if v > 0xff {
+			ret = append(ret, op|0x10, byte(v>>8), byte(v))
+		} else {
+			ret = append(ret, op, byte(v))
+		}
+	}
+	return
+}
+
+/*
+	Decode the flow specification NLRIs
+*/
+func unmarshalFlowSpecNLRI(in []byte) (ret []FlowSpecRule, err error) {
+	for len(in) > 0 {
+		l := int(in[0])
+		in = in[1:]
+		if l >= 0xf0 {
+			if len(in) < 1 {
+				err = fmt.Errorf("Truncated flow specification")
+				return
+			}
+			l = (l&0x0f)<<8 | int(in[0])
+			in = in[1:]
+		}
+		if l > len(in) {
+			err = fmt.Errorf("Truncated flow specification")
+			return
+		}
+
+		var r FlowSpecRule
+		r, err = unmarshalFlowSpecRule(in[:l])
+		if err != nil {
+			return
+		}
+		ret = append(ret, r)
+		in = in[l:]
+	}
+	return
+}
+
+/*
+	Decode components of a single flow specification NLRI
+*/
+func unmarshalFlowSpecRule(in []byte) (r FlowSpecRule, err error) {
+	for len(in) > 0 {
+		t := in[0]
+		in = in[1:]
+
+		switch t {
+		case flowSpecDestination, flowSpecSource:
+			if len(in) < 1 || in[0] > 32 || len(in) < 1+(int(in[0])+7)/8 {
+				err = fmt.Errorf("Invalid flow specification prefix")
+				return
+			}
+			m := int(in[0])
+			a := make(net.IP, net.IPv4len)
+			copy(a, in[1:1+(m+7)/8])
+			n := net.IPNet{IP: a, Mask: net.CIDRMask(m, 32)}
+			if t == flowSpecDestination {
+				r.Destination = n.String()
+			} else {
+				r.Source = n.String()
+			}
+			in = in[1+(m+7)/8:]
+		case flowSpecProtocol, flowSpecDestinationPort, flowSpecSourcePort:
+			var values []uint16
+			values, in, err = unmarshalFlowSpecNumeric(in)
+			if err != nil {
+				return
+			}
+			switch t {
+			case flowSpecProtocol:
+				for _, v := range values {
+					r.Protocols = append(r.Protocols, uint8(v))
+				}
+			case flowSpecDestinationPort:
+				r.DestinationPorts = values
+			case flowSpecSourcePort:
+				r.SourcePorts = values
+			}
+		default:
+			err = fmt.Errorf("Unsupported flow specification component %d", t)
+			return
+		}
+	}
+	return
+}
+
+/*
+	Decode the equality matches of the numeric component, returns
+	the rest of the input following the component. Other operators
+	are rejected, dropping them would widen the match.
+*/
+func unmarshalFlowSpecNumeric(in []byte) (values []uint16, rest []byte, err error) {
+	for {
+		if len(in) < 1 {
+			err = fmt.Errorf("Truncated flow specification component")
+			return
+		}
+		op := in[0]
+		l := 1 << ((op & flowSpecOpLen) >> 4)
+		if len(in) < 1+l || l > 2 {
+			err = fmt.Errorf("Invalid flow specification component")
+			return
+		}
+		var v uint16
+		if l == 2 {
+			v = binary.BigEndian.Uint16(in[1:3])
+		} else {
+			v = uint16(in[1])
+		}
+		if op&^(flowSpecOpEnd|flowSpecOpLen) != flowSpecOpEqual {
+			err = fmt.Errorf("Unsupported flow specification operator 0x%02x", op)
+			return
+		}
+		values = append(values, v)
+		in = in[1+l:]
+		if op&flowSpecOpEnd != 0 {
+			break
+		}
+	}
+	rest = in
+	return
+}
+
+/*
+	Return the extended communities carrying the actions of the rule
+*/
+func (r FlowSpecRule) extendedCommunities(as uint32) (ret []uint64) {
+	if !r.Discard && r.RateLimit <= 0 {
+		return
+	}
+	if as > 0xffff {
+		as = asTrans
+	}
+	rate := r.RateLimit
+	if r.Discard {
+		rate = 0
+	}
+	ret = append(ret, uint64(extCommunityTrafficRate)<<48|uint64(as)<<32|uint64(math.Float32bits(rate)))
+	return
+}
+
+/*
+	Set the actions of the rules from the received extended communities
+*/
+func applyFlowSpecActions(rules []FlowSpecRule, comms []uint64) {
+	for _, c := range comms {
+		if c>>48 != extCommunityTrafficRate {
+			continue
+		}
+		rate := math.Float32frombits(uint32(c))
+		for i := range rules {
+			rules[i].RateLimit = rate
+			rules[i].Discard = rate == 0
+		}
+	}
+}
+
+/*
+	Add the flow specification rule and advertise it to the BGP peer
+	if the flow specification is negotiated
+*/
+func (b *BGP) AddFlowSpec(r FlowSpecRule) error {
+	if !b.flowSpec {
+		return fmt.Errorf("AddFlowSpec: Flow specification not enabled")
+	}
+	if _, err := marshalFlowSpecNLRI(r); err != nil {
+		return fmt.Errorf("AddFlowSpec: %v", err)
+	}
+
+	b.mu.Lock()
+	if _, e := b.flowSpecs[r.key()]; e {
+		b.mu.Unlock()
+		return fmt.Errorf("AddFlowSpec: Rule alredy exists")
+	}
+	b.flowSpecs[r.key()] = r
+	b.mu.Unlock()
+
+	b.debug("Adding flow specification %+v", r)
+	return b.writeFlowSpec(MsgUpdate{FlowSpec: []FlowSpecRule{r}})
+}
+
+/*
+	Delete the flow specification rule and withdraw it from the BGP peer
+*/
+func (b *BGP) DelFlowSpec(r FlowSpecRule) error {
+	b.mu.Lock()
+	if _, e := b.flowSpecs[r.key()]; !e {
+		b.mu.Unlock()
+		return fmt.Errorf("DelFlowSpec: Rule not found")
+	}
+	delete(b.flowSpecs, r.key())
+	b.mu.Unlock()
+
+	b.debug("Removing flow specification %+v", r)
+	return b.writeFlowSpec(MsgUpdate{FlowSpecWithdrawns: []FlowSpecRule{r}})
+}
+
+/*
+	Advertise all flow specification rules, used when the session
+	gets established
+*/
+func (b *BGP) sendFlowSpecs() {
+	b.mu.Lock()
+	var rules []FlowSpecRule
+	for _, r := range b.flowSpecs {
+		rules = append(rules, r)
+	}
+	b.mu.Unlock()
+
+	for _, r := range rules {
+		if err := b.writeFlowSpec(MsgUpdate{FlowSpec: []FlowSpecRule{r}}); err != nil {
+			b.reportError("sendFlowSpecs", err)
+		}
+	}
+}
+
+/*
+	Send the flow specification update if negotiated with the BGP peer,
+	the actions are carried by the extended communities
+*/
+func (b *BGP) writeFlowSpec(m MsgUpdate) error {
+	if b.State() != StateEstablished || !b.sessionParams().FlowSpec {
+		return nil
+	}
+
+	if len(m.FlowSpec) > 0 {
+		m.Origin = OriginTypeIGP
+		if b.PeerAS() != b.as && b.disableASPrepend {
+			m.AsPath = TypeAsPath{Type: AsPathTypeSequence, Path: []uint32{b.as}}
+		}
+		m.ExtendedCommunities = m.FlowSpec[0].extendedCommunities(b.as)
+	}
+
+	return b.writeUpdate(m)
+}
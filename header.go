@@ -2,11 +2,27 @@ package gobgp
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 )
 
+/*
+	Returned for messages exceeding the maximum length
+*/
+var ErrMessageTooLong = errors.New("Message too long")
+
 const (
 	headerLength = 19
+
+	/*
+		Maximum length of a BGP message including the header
+	*/
+	maxMessageLength = 4096
+
+	/*
+		Maximum length of a BGP message with extended messages negotiated, RFC 8654
+	*/
+	maxExtendedMessageLength = 65535
 )
 
 var headerMarker = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
@@ -17,6 +33,15 @@ func marshalMessageHeader(t uint, l int) (ret []byte, err error) {
 		return
 	}
 
+	/*
+		The length field can not hold more, callers check the limit
+		negotiated for the session
+	*/
+	if l+headerLength > maxExtendedMessageLength {
+		err = fmt.Errorf("%w (%d)", ErrMessageTooLong, l+headerLength)
+		return
+	}
+
 	switch t {
 	case msgTypeOpen:
 	case msgTypeUpdate:
@@ -0,0 +1,55 @@
+/*
+	Readiness probes of the BGP sessions, kept in a separate package
+	to keep net/http out of the core
+*/
+package health
+
+import (
+	"net/http"
+)
+
+/*
+	Implemented by gobgp.BGP, ready when the session is Established
+*/
+type Readier interface {
+	Ready() bool
+}
+
+/*
+	Adapter of the ordinary function to Readier
+*/
+type ReadyFunc func() bool
+
+func (f ReadyFunc) Ready() bool {
+	return f()
+}
+
+/*
+	Return Readier which is ready when at least n of the sessions are ready
+*/
+func AtLeast(n int, rs ...Readier) Readier {
+	return ReadyFunc(func() bool {
+		var cnt int
+		for _, r := range rs {
+			if r.Ready() {
+				cnt++
+			}
+		}
+		return cnt >= n
+	})
+}
+
+/*
+	Return HTTP handler responding 200 when ready and 503 otherwise
+*/
+func Handler(r Readier) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if r.Ready() {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("OK\n"))
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Not ready\n"))
+	}
+}
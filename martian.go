@@ -0,0 +1,70 @@
+package gobgp
+
+import (
+	"fmt"
+	"net"
+)
+
+/*
+	Martian and bogon prefixes not expected to be advertised, the list
+	may be changed by the application before creating the BGP instances
+*/
+var Martians = []string{
+	"0.0.0.0/8",       // This network, RFC 791
+	"10.0.0.0/8",      // Private use, RFC 1918
+	"100.64.0.0/10",   // Shared address space, RFC 6598
+	"127.0.0.0/8",     // Loopback, RFC 1122
+	"169.254.0.0/16",  // Link local, RFC 3927
+	"172.16.0.0/12",   // Private use, RFC 1918
+	"192.0.0.0/24",    // IETF protocol assignments, RFC 6890
+	"192.0.2.0/24",    // Documentation, RFC 5737
+	"192.168.0.0/16",  // Private use, RFC 1918
+	"198.18.0.0/15",   // Benchmarking, RFC 2544
+	"198.51.100.0/24", // Documentation, RFC 5737
+	"203.0.113.0/24",  // Documentation, RFC 5737
+	"224.0.0.0/4",     // Multicast, RFC 5771
+	"240.0.0.0/4",     // Reserved, RFC 1112
+	"::/8",            // Loopback and unspecified, RFC 4291
+	"fc00::/7",        // Unique local, RFC 4193
+	"fe80::/10",       // Link local, RFC 4291
+	"ff00::/8",        // Multicast, RFC 4291
+	"2001:db8::/32",   // Documentation, RFC 3849
+}
+
+/*
+	Check whether the prefix falls into one of the martian prefixes
+*/
+func IsMartian(prefix string) bool {
+	_, p, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return false
+	}
+	ones, _ := p.Mask.Size()
+	for _, v := range Martians {
+		_, m, err := net.ParseCIDR(v)
+		if err != nil {
+			continue
+		}
+		if n, _ := m.Mask.Size(); n <= ones && m.Contains(p.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Report the martian prefix to the application, refused if configured
+*/
+func (b *BGP) checkMartian(prefix string) error {
+	if !IsMartian(prefix) {
+		return nil
+	}
+	b.debug("Prefix %s is martian", prefix)
+	if b.onMartian != nil {
+		b.onMartian(prefix)
+	}
+	if b.rejectMartians {
+		return fmt.Errorf("%w: %s", ErrMartianPrefix, prefix)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package gobgp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+/*
+	Check the number of received prefixes against the limit, the application
+	is notified when it crosses the warning thresholds. The session is closed
+	by the Maximum Number of Prefixes Reached notification when the limit
+	is exceeded.
+*/
+func (b *BGP) checkPrefixLimit() {
+	if b.maxPrefixes == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	count := uint32(len(b.adjRibIn))
+	var crossed []int
+	for _, t := range b.prefixThresholds {
+		reached := uint64(count)*100 >= uint64(t)*uint64(b.maxPrefixes)
+		if reached && !b.thresholdsCrossed[t] {
+			crossed = append(crossed, t)
+			b.thresholdsCrossed[t] = true
+		} else if !reached {
+			delete(b.thresholdsCrossed, t)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, t := range crossed {
+		b.debug("%s: Received %d prefixes, %d%% of the limit %d", b.peer, count, t, b.maxPrefixes)
+		if b.onPrefixThreshold != nil {
+			b.onPrefixThreshold(t, count, b.maxPrefixes)
+		}
+	}
+
+	if count <= b.maxPrefixes {
+		return
+	}
+
+	b.reportError(b.peer+": checkPrefixLimit", fmt.Errorf("Maximum number of prefixes %d exceeded", b.maxPrefixes))
+	// Cease, Maximum Number of Prefixes Reached
+	if err := b.sendNotification(6, 1, maxPrefixesData(b.maxPrefixes)); err != nil {
+		b.reportError("checkPrefixLimit", err)
+	}
+	b.disconnect("Maximum number of prefixes exceeded")
+}
+
+/*
+	Return the data of the Maximum Number of Prefixes Reached notification,
+	the AFI, SAFI and the upper bound, RFC 4486
+*/
+func maxPrefixesData(limit uint32) string {
+	data := make([]byte, 7)
+	binary.BigEndian.PutUint16(data[0:2], afiIPv4)
+	data[2] = safiUnicast
+	binary.BigEndian.PutUint32(data[3:7], limit)
+	return string(data)
+}
+
+/*
+	Return the sorted warning thresholds without duplicates
+*/
+func sortThresholds(in []int) (ret []int) {
+	seen := make(map[int]bool)
+	for _, v := range in {
+		if !seen[v] {
+			seen[v] = true
+			ret = append(ret, v)
+		}
+	}
+	sort.Ints(ret)
+	return
+}
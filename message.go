@@ -1,8 +1,10 @@
 package gobgp
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 )
 
 /*
@@ -19,35 +21,109 @@ const (
 type message struct {
 	Type uint
 	Data interface{}
+
+	/*
+		Generation of the connection the message was received on
+	*/
+	gen uint64
+}
+
+/*
+	Parameters negotiated for the session which affect the encoding of messages
+*/
+type sessionParams struct {
+	/*
+		AS numbers are encoded in 4 octets
+	*/
+	AS4 bool
+
+	/*
+		Messages up to 65535 octets are allowed
+	*/
+	ExtendedMessage bool
+
+	/*
+		IPv4 unicast routes are encoded in MP_REACH_NLRI and MP_UNREACH_NLRI
+	*/
+	MPReach bool
+
+	/*
+		Flow specification of IPv4 can be advertised
+	*/
+	FlowSpec bool
+
+	/*
+		IPv4 unicast NLRIs sent to the peer carry the path identifier
+	*/
+	AddPath bool
+
+	/*
+		Peer is in the same AS, the AS path of the advertised routes
+		may be empty
+	*/
+	IBGP bool
+
+	/*
+		Local AS prepended to the AS path of the advertised routes,
+		zero if the path is sent as it is
+	*/
+	PrependAS uint32
+
+	/*
+		Unrecognized well-known attributes are refused, set by
+		the configuration, not negotiated
+	*/
+	StrictAttributes bool
+
+	/*
+		Maximum number of announced and of withdrawn prefixes in a single
+		update built by the batching, set by the configuration, limited
+		by the message length only if zero
+	*/
+	MaxPrefixesPerUpdate int
+}
+
+/*
+	Return the maximum length of a message
+*/
+func (p sessionParams) maxLength() int {
+	if p.ExtendedMessage {
+		return maxExtendedMessageLength
+	}
+	return maxMessageLength
 }
 
-func marshalMessage(m message) (ret []byte, err error) {
-	switch m.Data.(type) {
-	case msgOpen:
-		if m.Type != msgTypeOpen {
+func marshalMessage(m message, p sessionParams) (ret []byte, err error) {
+	/*
+		Data must match the message type, KEEPALIVE carries none
+	*/
+	switch m.Type {
+	case msgTypeOpen:
+		d, ok := m.Data.(msgOpen)
+		if !ok {
 			err = fmt.Errorf("Message type mismatch")
 			return
 		}
-	case MsgUpdate:
-		if m.Type != msgTypeUpdate {
+		ret, err = marshalMessageOpen(d)
+	case msgTypeUpdate:
+		d, ok := m.Data.(MsgUpdate)
+		if !ok {
 			err = fmt.Errorf("Message type mismatch")
 			return
 		}
-	case msgNotification:
-		if m.Type != msgTypeNotification {
+		ret, err = marshalMessageUpdate(d, p)
+	case msgTypeNotification:
+		d, ok := m.Data.(msgNotification)
+		if !ok {
 			err = fmt.Errorf("Message type mismatch")
 			return
 		}
-	}
-
-	switch m.Type {
-	case msgTypeOpen:
-		ret, err = marshalMessageOpen(m.Data.(msgOpen))
-	case msgTypeUpdate:
-		ret, err = marshalMessageUpdate(m.Data.(MsgUpdate))
-	case msgTypeNotification:
-		ret, err = marshalMessageNotification(m.Data.(msgNotification))
+		ret, err = marshalMessageNotification(d)
 	case msgTypeKeepAlive:
+		if m.Data != nil {
+			err = fmt.Errorf("Message type mismatch")
+			return
+		}
 		/*
 			Nothing to marshal, just set the message type
 		*/
@@ -59,7 +135,67 @@ func marshalMessage(m message) (ret []byte, err error) {
 	return
 }
 
-func unmarshalMessage(in []byte) (ret message, err error) {
+/*
+	Write the whole buffer to the stream, retrying after short writes
+*/
+func writeFull(w io.Writer, buf []byte) error {
+	for len(buf) > 0 {
+		n, err := w.Write(buf)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
+
+/*
+	Read a single message not longer than max from the stream, the returned
+	slice starts after the header marker as expected by unmarshalMessage.
+	Invalid headers are reported by a notificationError.
+*/
+func readFrame(r io.Reader, max int) (ret []byte, err error) {
+	buf := make([]byte, headerLength)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return
+	}
+	if !bytes.Equal(buf[:len(headerMarker)], headerMarker) {
+		// Message Header Error, Connection Not Synchronized
+		err = newNotificationError(1, 1, nil, "Connection not synchronized")
+		return
+	}
+
+	lb := buf[len(headerMarker) : len(headerMarker)+2]
+	l := int(binary.BigEndian.Uint16(lb))
+	if l < headerLength {
+		// Message Header Error, Bad Message Length
+		err = newNotificationError(1, 2, lb, "Message too small")
+		return
+	}
+	if l > max {
+		// Message Header Error, Bad Message Length
+		err = newNotificationError(1, 2, lb, "Message too long (%d)", l)
+		return
+	}
+
+	t := buf[headerLength-1]
+	if t < msgTypeOpen || t > msgTypeKeepAlive {
+		// Message Header Error, Bad Message Type
+		err = newNotificationError(1, 3, []byte{t}, "Unknown message type %d", t)
+		return
+	}
+
+	ret = make([]byte, l-len(headerMarker))
+	copy(ret, buf[len(headerMarker):])
+	_, err = io.ReadFull(r, ret[headerLength-len(headerMarker):])
+
+	return
+}
+
+func unmarshalMessage(in []byte, p sessionParams) (ret message, err error) {
 	/*
 		Message length
 	*/
@@ -81,13 +217,14 @@ func unmarshalMessage(in []byte) (ret message, err error) {
 	case msgTypeOpen:
 		ret.Data, err = unmarshalMessageOpen(in[3:])
 	case msgTypeUpdate:
-		ret.Data, err = unmarshalMessageUpdate(in[3:])
+		ret.Data, err = unmarshalMessageUpdate(in[3:], p)
 	case msgTypeNotification:
 		ret.Data, err = unmarshalMessageNotification(in[3:])
 	case msgTypeKeepAlive:
 		// Nothing to parse, just reset timer
 	default:
-		err = fmt.Errorf("Unknown message type %d", ret.Type)
+		// Message Header Error, Bad Message Type
+		err = newNotificationError(1, 3, []byte{in[2]}, "Unknown message type %d", ret.Type)
 	}
 
 	return
@@ -2,6 +2,7 @@ package gobgp
 
 import (
 	"fmt"
+	"strings"
 )
 
 type msgNotification struct {
@@ -51,6 +52,15 @@ var (
 		11: "Malformed AS_PATH",
 	}
 
+	/*
+		Finite State Machine Error subcodes, RFC 6608
+	*/
+	msgErrSubCodesFSM = map[uint8]string{
+		1: "Receive Unexpected Message in OpenSent State",
+		2: "Receive Unexpected Message in OpenConfirm State",
+		3: "Receive Unexpected Message in Established State",
+	}
+
 	msgErrSubCodesCease = map[uint8]string{
 		1:  "Maximum Number of Prefixes Reached",
 		2:  "Administrative Shutdown",
@@ -65,30 +75,156 @@ var (
 	}
 )
 
+/*
+	Error found in a received message which is reported to the peer
+	by the NOTIFICATION message
+*/
+type notificationError struct {
+	/*
+		NOTIFICATION message to send
+	*/
+	msg msgNotification
+
+	/*
+		Description of the error
+	*/
+	reason string
+}
+
+func newNotificationError(code, subcode uint8, data []byte, f string, a ...interface{}) *notificationError {
+	return &notificationError{
+		msg:    msgNotification{Code: code, SubCode: subcode, Data: string(data)},
+		reason: fmt.Sprintf(f, a...),
+	}
+}
+
+/*
+	Return the notification with the names of the error code and subcode
+*/
+func (m msgNotification) String() string {
+	s, ok := msgErrCodes[m.Code]
+	if !ok {
+		s = fmt.Sprintf("Unknown error code %d", m.Code)
+	}
+
+	var subcodes map[uint8]string
+	switch m.Code {
+	case 1:
+		subcodes = msgErrSubCodesMsg
+	case 2:
+		subcodes = msgErrSubCodesOpen
+	case 3:
+		subcodes = msgErrSubCodesUpdate
+	case 5:
+		subcodes = msgErrSubCodesFSM
+	case 6:
+		subcodes = msgErrSubCodesCease
+	}
+	if n, ok := subcodes[m.SubCode]; ok {
+		s += ": " + n
+	} else if m.SubCode != 0 {
+		s += fmt.Sprintf(": Unknown subcode %d", m.SubCode)
+	}
+
+	if d := m.dataString(); len(d) > 0 {
+		s += ": " + d
+	}
+	return s
+}
+
+/*
+	Check whether the notification is the Administrative Shutdown
+	or the Administrative Reset
+*/
+func (m msgNotification) isShutdown() bool {
+	return m.Code == 6 && (m.SubCode == 2 || m.SubCode == 4)
+}
+
+/*
+	Return the shutdown communication message, RFC 8203, empty if the data
+	is not a valid length prefixed message
+*/
+func (m msgNotification) shutdownMessage() string {
+	if !m.isShutdown() || len(m.Data) < 1 || int(m.Data[0]) != len(m.Data)-1 {
+		return ""
+	}
+	return m.Data[1:]
+}
+
+/*
+	Return the data of the notification in a human readable form,
+	the capabilities of the Unsupported Capability are listed and
+	the shutdown communication message is shown
+*/
+func (m msgNotification) dataString() string {
+	if m.isShutdown() && len(m.Data) > 0 {
+		if s := m.shutdownMessage(); len(s) > 0 {
+			return s
+		}
+	}
+	if m.Code == 2 && m.SubCode == 7 && len(m.Data) > 0 {
+		caps, err := unmarshalCapabilities([]byte(m.Data))
+		if err == nil {
+			var s []string
+			for _, v := range caps {
+				s = append(s, v.String())
+			}
+			return "Capabilities " + strings.Join(s, ", ")
+		}
+	}
+	return m.Data
+}
+
+/*
+	Return the Finite State Machine Error subcode of an unexpected message
+	received in the state, unspecific for other states
+*/
+func fsmErrorSubCode(s State) uint8 {
+	switch s {
+	case StateOpenSent:
+		return 1
+	case StateOpenConfirm:
+		return 2
+	case StateEstablished:
+		return 3
+	}
+	return 0
+}
+
+func (e *notificationError) Error() string {
+	return e.reason
+}
+
 func marshalMessageNotification(m msgNotification) (ret []byte, err error) {
 	if _, ok := msgErrCodes[m.Code]; !ok {
 		err = fmt.Errorf("Invalid notification error code")
 		return
 	}
 
-	switch m.Code {
-	case 1:
+	switch {
+	case m.SubCode == 0:
+		// Unspecific
+	case m.Code == 1:
 		if _, ok := msgErrSubCodesMsg[m.SubCode]; !ok {
 			err = fmt.Errorf("Invalid notification message error subcode")
 			return
 		}
-	case 2:
+	case m.Code == 2:
 		if _, ok := msgErrSubCodesOpen[m.SubCode]; !ok {
 			err = fmt.Errorf("Invalid notification open error subcode")
 			return
 		}
-	case 3:
+	case m.Code == 3:
 		if _, ok := msgErrSubCodesUpdate[m.SubCode]; !ok {
 			err = fmt.Errorf("Invalid notification update error subcode")
 			return
 		}
 	}
 
+	/*
+		Code and subcode, the data is optional, without it the message
+		is 21 octets long including the header
+	*/
 	buf := make([]byte, 2)
 	buf[0] = m.Code
 	buf[1] = m.SubCode
@@ -113,6 +249,9 @@ func unmarshalMessageNotification(in []byte) (ret msgNotification, err error) {
 		err = fmt.Errorf("Message too small")
 		return
 	}
+	/*
+		Notification without data is the common case, the Data stays empty
+	*/
 	if l > 2 {
 		ret.Data = string(in[2:])
 	}
@@ -124,6 +263,13 @@ func unmarshalMessageNotification(in []byte) (ret msgNotification, err error) {
 		return
 	}
 
+	/*
+		Unspecific subcode is used if no appropriate one is defined
+	*/
+	if ret.SubCode == 0 {
+		return
+	}
+
 	switch ret.Code {
 	case 1:
 		if _, ok := msgErrSubCodesMsg[ret.SubCode]; !ok {
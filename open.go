@@ -1,19 +1,66 @@
 package gobgp
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"net"
+	"strconv"
 )
 
 const (
 	bgpVersion = 4
+
+	/*
+		AS number used in place of 4-octet AS numbers, RFC 6793
+	*/
+	asTrans = 23456
+)
+
+/*
+	Types of optional parameters
+*/
+const (
+	optParamCapabilities = 2
 )
 
+/*
+	Capability codes
+*/
+const (
+	capabilityMultiprotocol   = 1
+	capabilityExtendedMessage = 6
+	capabilityFourOctetAS     = 65
+	capabilityAddPath         = 69
+)
+
+/*
+	Send / receive modes of the ADD-PATH capability, RFC 7911
+*/
+const (
+	addPathReceive = 1
+	addPathSend    = 2
+)
+
+/*
+	Capability advertised in the OPEN message, RFC 5492
+*/
+type Capability struct {
+	Code  uint8
+	Value []byte
+
+	/*
+		Refuse the peer not advertising the capability by the Unsupported
+		Capability notification, not encoded in the message
+	*/
+	Required bool
+}
+
 type msgOpen struct {
-	ASN      uint16
-	HoldTime uint16
-	RouterID string
+	ASN          uint32
+	HoldTime     uint16
+	RouterID     string
+	Capabilities []Capability
 }
 
 func marshalMessageOpen(m msgOpen) (ret []byte, err error) {
@@ -23,13 +70,34 @@ func marshalMessageOpen(m msgOpen) (ret []byte, err error) {
 		return
 	}
 
+	/*
+		AS numbers not fitting into the 2-octet field are carried
+		by the 4-octet AS capability only
+	*/
+	as := m.ASN
+	if as > 0xffff {
+		as = asTrans
+		if !m.hasCapability(capabilityFourOctetAS) {
+			c := Capability{Code: capabilityFourOctetAS, Value: make([]byte, 4)}
+			binary.BigEndian.PutUint32(c.Value, m.ASN)
+			m.Capabilities = append(m.Capabilities, c)
+		}
+	}
+
 	buf := make([]byte, 5)
 
 	buf[0] = bgpVersion
-	binary.BigEndian.PutUint16(buf[1:3], m.ASN)
+	binary.BigEndian.PutUint16(buf[1:3], uint16(as))
 	binary.BigEndian.PutUint16(buf[3:5], m.HoldTime)
 	buf = append(buf, n...)
-	buf = append(buf, 0)
+
+	caps := marshalCapabilities(m.Capabilities)
+	if len(caps) > 0 {
+		buf = append(buf, byte(len(caps)+2), optParamCapabilities, byte(len(caps)))
+		buf = append(buf, caps...)
+	} else {
+		buf = append(buf, 0)
+	}
 
 	h, err := marshalMessageHeader(msgTypeOpen, len(buf))
 	if err != nil {
@@ -43,14 +111,194 @@ func marshalMessageOpen(m msgOpen) (ret []byte, err error) {
 }
 
 func unmarshalMessageOpen(in []byte) (ret msgOpen, err error) {
+	if len(in) < 10 {
+		err = fmt.Errorf("Message too small")
+		return
+	}
+
 	if in[0] != bgpVersion {
 		err = fmt.Errorf("Unsupported BGP protocol version")
 		return
 	}
 
-	ret.ASN = binary.BigEndian.Uint16(in[1:3])
+	ret.ASN = uint32(binary.BigEndian.Uint16(in[1:3]))
 	ret.HoldTime = binary.BigEndian.Uint16(in[3:5])
 	ret.RouterID = net.IPv4(in[5], in[6], in[7], in[8]).String()
 
+	/*
+		Optional parameters
+	*/
+	l := int(in[9])
+	if len(in) < 10+l {
+		err = fmt.Errorf("Invalid optional parameters length")
+		return
+	}
+	params := in[10 : 10+l]
+	for len(params) >= 2 {
+		t, pl := params[0], int(params[1])
+		if len(params) < 2+pl {
+			err = fmt.Errorf("Invalid optional parameter length")
+			return
+		}
+		if t == optParamCapabilities {
+			var caps []Capability
+			caps, err = unmarshalCapabilities(params[2 : 2+pl])
+			if err != nil {
+				return
+			}
+			ret.Capabilities = append(ret.Capabilities, caps...)
+		}
+		params = params[2+pl:]
+	}
+
+	/*
+		The real AS number of a 4-octet AS speaker is in the capability
+	*/
+	for _, v := range ret.Capabilities {
+		if v.Code == capabilityFourOctetAS && len(v.Value) == 4 {
+			ret.ASN = binary.BigEndian.Uint32(v.Value)
+		}
+	}
+
 	return
 }
+
+/*
+	Encode the list of capabilities, used by the OPEN message and
+	by the Unsupported Capability notification
+*/
+func marshalCapabilities(caps []Capability) (ret []byte) {
+	for _, v := range caps {
+		ret = append(ret, v.Code, byte(len(v.Value)))
+		ret = append(ret, v.Value...)
+	}
+	return
+}
+
+/*
+	Decode the list of capabilities
+*/
+func unmarshalCapabilities(in []byte) (ret []Capability, err error) {
+	for len(in) >= 2 {
+		cl := int(in[1])
+		if len(in) < 2+cl {
+			err = fmt.Errorf("Invalid capability length")
+			return
+		}
+		ret = append(ret, Capability{Code: in[0], Value: in[2 : 2+cl]})
+		in = in[2+cl:]
+	}
+	return
+}
+
+/*
+	Return the capability in a human readable form
+*/
+func (c Capability) String() string {
+	if c.Code == capabilityMultiprotocol && len(c.Value) == 4 {
+		return fmt.Sprintf("%d (AFI %d SAFI %d)", c.Code, binary.BigEndian.Uint16(c.Value[0:2]), c.Value[3])
+	}
+	return strconv.Itoa(int(c.Code))
+}
+
+/*
+	Return the required capabilities not advertised in the OPEN message,
+	multiprotocol capabilities are compared including the address family
+*/
+func (m msgOpen) missingCapabilities(caps []Capability) (ret []Capability) {
+	for _, c := range caps {
+		if !c.Required {
+			continue
+		}
+		found := false
+		for _, v := range m.Capabilities {
+			if v.Code == c.Code && (c.Code != capabilityMultiprotocol || bytes.Equal(v.Value, c.Value)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ret = append(ret, c)
+		}
+	}
+	return
+}
+
+/*
+	Return the multiprotocol capability of the address family, RFC 4760
+*/
+func multiprotocolCapability(afi uint16, safi uint8) Capability {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint16(v[0:2], afi)
+	v[3] = safi
+	return Capability{Code: capabilityMultiprotocol, Value: v}
+}
+
+/*
+	Check whether the multiprotocol capability of the address family
+	is advertised in the OPEN message
+*/
+func (m msgOpen) hasMultiprotocol(afi uint16, safi uint8) bool {
+	for _, v := range m.Capabilities {
+		if v.Code == capabilityMultiprotocol && len(v.Value) == 4 &&
+			binary.BigEndian.Uint16(v.Value[0:2]) == afi && v.Value[3] == safi {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Return the ADD-PATH capability of the address family with the mode
+*/
+func addPathCapability(afi uint16, safi uint8, mode uint8) Capability {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint16(v[0:2], afi)
+	v[2] = safi
+	v[3] = mode
+	return Capability{Code: capabilityAddPath, Value: v}
+}
+
+/*
+	Return the ADD-PATH mode of the address family advertised in the OPEN
+	message, zero if not advertised
+*/
+func (m msgOpen) addPathMode(afi uint16, safi uint8) uint8 {
+	for _, v := range m.Capabilities {
+		if v.Code != capabilityAddPath {
+			continue
+		}
+		for x := v.Value; len(x) >= 4; x = x[4:] {
+			if binary.BigEndian.Uint16(x[0:2]) == afi && x[2] == safi {
+				return x[3]
+			}
+		}
+	}
+	return 0
+}
+
+/*
+	Append the capability unless the same one is already in the list,
+	the existing one is marked as required if requested
+*/
+func appendCapability(list []Capability, c Capability) []Capability {
+	for i, v := range list {
+		if v.Code == c.Code && bytes.Equal(v.Value, c.Value) {
+			list[i].Required = v.Required || c.Required
+			return list
+		}
+	}
+	return append(list, c)
+}
+
+/*
+	Check whether the capability is advertised in the OPEN message
+*/
+func (m msgOpen) hasCapability(c uint8) bool {
+	for _, v := range m.Capabilities {
+		if v.Code == c {
+			return true
+		}
+	}
+	return false
+}
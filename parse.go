@@ -2,16 +2,47 @@ package gobgp
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 )
 
-func parsePrefix(x string) (n uint32, m uint8, err error) {
+/*
+	Returned for prefixes of an address family which can not be advertised yet
+*/
+var ErrUnsupportedAddressFamily = errors.New("Unsupported address family")
+
+/*
+	Address family identifiers
+*/
+const (
+	afiIPv4 = 1
+	afiIPv6 = 2
+)
+
+/*
+	Subsequent address family identifiers
+*/
+const (
+	safiUnicast = 1
+)
+
+/*
+	Parse the prefix in CIDR notation, returns the address family,
+	the network address (4 octets for IPv4, 16 for IPv6) and the mask length
+*/
+func parsePrefix(x string) (afi uint16, n []byte, m uint8, err error) {
 	_, p, err := net.ParseCIDR(x)
 	if err != nil {
 		return
 	}
-	n = binary.BigEndian.Uint32(p.IP.To4())
+	if v4 := p.IP.To4(); v4 != nil {
+		afi = afiIPv4
+		n = v4
+	} else {
+		afi = afiIPv6
+		n = p.IP.To16()
+	}
 	s, _ := p.Mask.Size()
 	m = uint8(s)
 	return
@@ -52,23 +83,77 @@ func parsePeerAddress(x string) (string, error) {
 	return "", fmt.Errorf("Not found any valid peer IP address")
 }
 
-func parseNotificationMessage(m msgNotification) (ret string, err error) {
-	switch m.Code {
-	case 1:
-		ret = fmt.Sprintf("Message Header Error, %s", msgErrSubCodesMsg[m.SubCode])
-	case 2:
-		ret = fmt.Sprintf("OPEN Message Error, %s", msgErrSubCodesOpen[m.SubCode])
-	case 3:
-		ret = fmt.Sprintf("UPDATE Message Error, %s", msgErrSubCodesUpdate[m.SubCode])
-	case 4:
-		ret = fmt.Sprintf("Hold Timer Expired")
-	case 5:
-		ret = fmt.Sprintf("Finite State Machine Error")
-	case 6:
-		ret = fmt.Sprintf("Cease, %s", msgErrSubCodesCease[m.SubCode])
+/*
+	Check whether the IP address belongs to this host
+*/
+func isLocalAddress(x string) (bool, error) {
+	ip := net.ParseIP(x)
+	if ip == nil {
+		return false, fmt.Errorf("Invalid IP address %s", x)
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true, nil
+	}
+
+	a, err := net.InterfaceAddrs()
+	if err != nil {
+		return false, err
+	}
+	for _, v := range a {
+		if n, ok := v.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+/*
+	Derive the Router ID from the local address if it is a specific IPv4
+	address, otherwise use the highest non-loopback IPv4 address of
+	the local interfaces
+*/
+func deriveRouterID(local net.IP) (string, error) {
+	if local.To4() != nil && !local.IsUnspecified() {
+		return local.To4().String(), nil
 	}
-	if len(m.Data) > 0 {
-		ret = fmt.Sprintf("%s, %s", ret, m.Data)
+
+	a, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+
+	var id net.IP
+	for _, v := range a {
+		n, ok := v.(*net.IPNet)
+		if !ok || n.IP.IsLoopback() {
+			continue
+		}
+		ip := n.IP.To4()
+		if ip == nil {
+			continue
+		}
+		if id == nil || binary.BigEndian.Uint32(ip) > binary.BigEndian.Uint32(id) {
+			id = ip
+		}
+	}
+
+	if id == nil {
+		return "", fmt.Errorf("Unable to derive Router ID, no IPv4 address found")
+	}
+
+	return id.String(), nil
+}
+
+/*
+	Return the received notification in a human readable form, see
+	msgNotification.String
+*/
+func parseNotificationMessage(m msgNotification) (ret string, err error) {
+	if _, ok := msgErrCodes[m.Code]; !ok {
+		err = fmt.Errorf("parseNotificationMessage: Unknown error code %d", m.Code)
+		return
 	}
+	ret = m.String()
 	return
 }
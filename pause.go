@@ -0,0 +1,122 @@
+package gobgp
+
+import (
+	"fmt"
+)
+
+/*
+	Suppress the outbound updates to the peer while the session and the
+	keepalives stay up, all advertised prefixes are withdrawn first if requested
+*/
+func (b *BGP) Pause(withdraw bool) error {
+	b.mu.Lock()
+	if b.paused {
+		b.mu.Unlock()
+		return fmt.Errorf("Pause: Alredy paused")
+	}
+	b.mu.Unlock()
+
+	if withdraw && b.State() == StateEstablished {
+		if err := b.withdrawAll(); err != nil {
+			return fmt.Errorf("Pause: %v", err)
+		}
+	}
+
+	b.mu.Lock()
+	b.paused = true
+	b.mu.Unlock()
+	b.debug("%s: Paused", b.peer)
+
+	return nil
+}
+
+/*
+	Resume the outbound updates to the peer by the resend of all prefixes,
+	the prefixes deleted while paused are withdrawn
+*/
+func (b *BGP) Resume() error {
+	b.mu.Lock()
+	if !b.paused {
+		b.mu.Unlock()
+		return fmt.Errorf("Resume: Not paused")
+	}
+	b.paused = false
+	ws := b.suppressed
+	b.suppressed = nil
+	b.mu.Unlock()
+	b.debug("%s: Resumed", b.peer)
+
+	if b.State() != StateEstablished {
+		return nil
+	}
+	for _, m := range ws {
+		if err := b.writeUpdate(m); err != nil {
+			return fmt.Errorf("Resume: %v", err)
+		}
+	}
+	b.resendAll()
+
+	return nil
+}
+
+/*
+	Is the peer paused?
+*/
+func (b *BGP) Paused() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.paused
+}
+
+/*
+	Check whether the update is suppressed, the withdrawals are kept
+	to be sent on resume. While shutting down, the pause is ignored and
+	only the withdrawals are sent.
+*/
+func (b *BGP) suppress(m MsgUpdate) (MsgUpdate, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.shuttingDown {
+		if len(m.Prefixes) == 0 && len(m.FlowSpec) == 0 {
+			return m, false
+		}
+		m.Prefixes = nil
+		m.FlowSpec = nil
+		return m, len(m.Withdrawns) == 0 && len(m.FlowSpecWithdrawns) == 0
+	}
+	if !b.paused {
+		return m, false
+	}
+	if len(m.Withdrawns) > 0 {
+		b.suppressed = append(b.suppressed, MsgUpdate{Withdrawns: m.Withdrawns, PathID: m.PathID})
+	}
+	return m, true
+}
+
+/*
+	Withdraw all advertised prefixes including the weighted paths,
+	the prefixes stay in the internal database
+*/
+func (b *BGP) withdrawAll() error {
+	b.debug("%s: Withdrawing all advertised prefixes", b.peer)
+	var ws []MsgUpdate
+	for k := range b.routes() {
+		ws = append(ws, MsgUpdate{Withdrawns: []string{k}})
+	}
+	params := b.sessionParams()
+	for _, m := range coalesceUpdates(ws) {
+		for _, v := range splitUpdate(m, params) {
+			if err := b.writeUpdate(v); err != nil {
+				return err
+			}
+		}
+	}
+	for _, ms := range b.weightedRoutes() {
+		for _, m := range ms {
+			if err := b.writeUpdate(MsgUpdate{Withdrawns: m.Prefixes, PathID: m.PathID}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
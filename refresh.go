@@ -0,0 +1,77 @@
+package gobgp
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+	Periodically resend the update of the prefix unchanged, for peers aging out
+	the routes which are not refreshed. Zero interval cancels the refresh,
+	the refresh is cancelled by deleting the prefix or by Disconnect as well.
+*/
+func (b *BGP) Refresh(prefix string, interval time.Duration) error {
+	b.mu.Lock()
+	if _, ok := b.db[prefix]; !ok {
+		b.mu.Unlock()
+		return fmt.Errorf("Refresh: Prefix %s not found", prefix)
+	}
+	if c, ok := b.refresh[prefix]; ok {
+		close(c)
+		delete(b.refresh, prefix)
+	}
+	if interval <= 0 {
+		b.mu.Unlock()
+		b.debug("Cancelling refresh of prefix %s", prefix)
+		return nil
+	}
+	c := make(chan struct{})
+	b.refresh[prefix] = c
+	b.mu.Unlock()
+
+	b.debug("Refreshing prefix %s every %v", prefix, interval)
+	b.spawn(func() { b.refreshPrefix(prefix, interval, c) })
+	return nil
+}
+
+/*
+	Cancel the refresh of the prefix
+*/
+func (b *BGP) cancelRefresh(prefix string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c, ok := b.refresh[prefix]; ok {
+		close(c)
+		delete(b.refresh, prefix)
+	}
+}
+
+/*
+	Resend the update of the prefix at the interval while the session
+	is established, until cancelled or stopped
+*/
+func (b *BGP) refreshPrefix(prefix string, interval time.Duration, cancel chan struct{}) {
+	for {
+		select {
+		case <-cancel:
+			return
+		case <-b.stopping:
+			b.mu.Lock()
+			if b.refresh[prefix] == cancel {
+				delete(b.refresh, prefix)
+			}
+			b.mu.Unlock()
+			return
+		case <-b.clock.After(interval):
+		}
+
+		m, ok := b.Get(prefix)
+		if !ok || b.State() != StateEstablished {
+			continue
+		}
+		b.debug("%s: Refreshing prefix %s", b.peer, prefix)
+		if err := b.sendUpdate(m); err != nil {
+			b.reportError("refreshPrefix", err)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package gobgp
+
+import (
+	"io"
+)
+
+/*
+	Parameters of the captured session needed to decode its messages
+*/
+type ReplayOptions struct {
+	/*
+		AS numbers are encoded in 4 octets
+	*/
+	AS4 bool
+
+	/*
+		Refuse unrecognized well-known attributes
+	*/
+	StrictAttributes bool
+}
+
+/*
+	Decode all BGP messages from the stream of raw messages, as captured
+	from a session, and return the UPDATE messages, the other messages are
+	checked and skipped. Useful in the tests of the applications for checking
+	the decoding of messages received from real peers, the first decoding
+	error is returned.
+*/
+func ReplayFromReader(r io.Reader, o ReplayOptions) (ret []MsgUpdate, err error) {
+	p := sessionParams{AS4: o.AS4, StrictAttributes: o.StrictAttributes}
+	for {
+		var in []byte
+		in, err = readFrame(r, maxExtendedMessageLength)
+		if err == io.EOF {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		var m message
+		m, err = unmarshalMessage(in, p)
+		if err != nil {
+			return
+		}
+		if m.Type == msgTypeUpdate {
+			ret = append(ret, m.Data.(MsgUpdate))
+		}
+	}
+}
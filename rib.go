@@ -0,0 +1,281 @@
+package gobgp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+)
+
+/*
+	Store the received update in the Adj-RIB-In and pass the routes
+	accepted by the import policy to the update handler
+*/
+func (b *BGP) importUpdate(u MsgUpdate) {
+	b.mu.Lock()
+	policy := b.importPolicy
+	b.mu.Unlock()
+
+	routes := make(map[string]MsgUpdate)
+	accepted := make(map[string]bool)
+	for _, p := range u.Prefixes {
+		m := singlePrefix(u, p)
+		m.ValidationState = b.validationState(p, m)
+		routes[p] = m
+		accepted[p] = policy == nil || policy(p, m)
+	}
+
+	/*
+		Flow specification rules are passed as they are, announced prefixes
+		are passed grouped by the validation state
+	*/
+	out := u
+	out.Prefixes = nil
+	out.Withdrawns = nil
+	byState := make(map[ValidationState]*MsgUpdate)
+
+	b.mu.Lock()
+	for _, p := range u.Withdrawns {
+		_, e := b.adjRibIn[p]
+		if e {
+			b.dampFlap(p, dampingWithdrawPenalty)
+		}
+		/*
+			Withdrawals of routes rejected by the policy or suppressed
+			by the damping are not passed
+		*/
+		if (!e && !b.isSuppressed(p)) || b.imported[p] {
+			out.Withdrawns = append(out.Withdrawns, p)
+		}
+		delete(b.adjRibIn, p)
+		delete(b.imported, p)
+	}
+	for _, p := range u.Prefixes {
+		/*
+			Re-announcements with the same attributes are not flaps
+		*/
+		if old, e := b.adjRibIn[p]; e && !reflect.DeepEqual(old, routes[p]) {
+			b.dampFlap(p, dampingAttributePenalty)
+		}
+		b.adjRibIn[p] = routes[p]
+		if accepted[p] && !b.isSuppressed(p) {
+			s := routes[p].ValidationState
+			if byState[s] == nil {
+				x := singlePrefix(u, p)
+				x.Prefixes = nil
+				x.ValidationState = s
+				byState[s] = &x
+			}
+			byState[s].Prefixes = append(byState[s].Prefixes, p)
+			b.imported[p] = true
+		} else if b.imported[p] {
+			out.Withdrawns = append(out.Withdrawns, p)
+			delete(b.imported, p)
+		}
+	}
+	b.mu.Unlock()
+
+	/*
+		Prefixes of the single state are passed together with the rest
+	*/
+	if len(byState) == 1 {
+		for _, v := range byState {
+			out.Prefixes = v.Prefixes
+			out.ValidationState = v.ValidationState
+		}
+		byState = nil
+	}
+	b.deliverUpdate(out)
+	for _, v := range byState {
+		b.deliverUpdate(*v)
+	}
+}
+
+/*
+	Pass the update to the application
+*/
+func (b *BGP) deliverUpdate(u MsgUpdate) {
+	if len(u.Prefixes) == 0 && len(u.Withdrawns) == 0 && len(u.FlowSpec) == 0 && len(u.FlowSpecWithdrawns) == 0 {
+		return
+	}
+	b.updateHandler(u)
+	b.emit(Event{Type: EventUpdate, Update: u})
+}
+
+/*
+	Check whether the export policy accepts the route of the prefix
+*/
+func (b *BGP) exportAllowed(prefix string, m MsgUpdate) bool {
+	b.mu.Lock()
+	policy := b.exportPolicy
+	b.mu.Unlock()
+	return policy == nil || policy(prefix, m)
+}
+
+/*
+	Remove the prefixes rejected by the export policy from the update,
+	false if nothing is left to send
+*/
+func (b *BGP) applyExportPolicy(m MsgUpdate) (MsgUpdate, bool) {
+	if len(m.Prefixes) == 0 {
+		return m, true
+	}
+	var accepted []string
+	for _, p := range m.Prefixes {
+		if b.exportAllowed(p, singlePrefix(m, p)) {
+			accepted = append(accepted, p)
+		}
+	}
+	m.Prefixes = accepted
+	return m, len(m.Prefixes) > 0 || len(m.Withdrawns) > 0 || len(m.FlowSpec) > 0 || len(m.FlowSpecWithdrawns) > 0
+}
+
+/*
+	Set the import policy, use SoftReconfigIn to apply it to already received routes
+*/
+func (b *BGP) SetImportPolicy(f func(prefix string, m MsgUpdate) bool) {
+	b.mu.Lock()
+	b.importPolicy = f
+	b.mu.Unlock()
+}
+
+/*
+	Apply the current import policy to the routes stored in the Adj-RIB-In and
+	pass the resulting changes to the update handler without asking the peer
+	to resend the routes
+*/
+func (b *BGP) SoftReconfigIn() error {
+	if !b.running {
+		return fmt.Errorf("SoftReconfigIn: Not running")
+	}
+
+	b.mu.Lock()
+	policy := b.importPolicy
+	rib := make(map[string]MsgUpdate, len(b.adjRibIn))
+	for k, v := range b.adjRibIn {
+		rib[k] = v
+	}
+	b.mu.Unlock()
+
+	b.debug("%s: Soft reconfiguration of %d received routes", b.peer, len(rib))
+
+	var withdrawn MsgUpdate
+	for p, m := range rib {
+		ok := policy == nil || policy(p, m)
+
+		b.mu.Lock()
+		if _, e := b.adjRibIn[p]; !e {
+			/*
+				Withdrawn by the peer in the meantime
+			*/
+			b.mu.Unlock()
+			continue
+		}
+		was := b.imported[p]
+		ok = ok && !b.isSuppressed(p)
+		if ok {
+			b.imported[p] = true
+		} else {
+			delete(b.imported, p)
+		}
+		b.mu.Unlock()
+
+		switch {
+		case ok && !was:
+			b.deliverUpdate(m)
+		case !ok && was:
+			withdrawn.Withdrawns = append(withdrawn.Withdrawns, p)
+		}
+	}
+	b.deliverUpdate(withdrawn)
+
+	return nil
+}
+
+/*
+	Write the routes of the Adj-RIB-In as a JSON object indexed by the prefix,
+	the routes rejected by the import policy included
+*/
+func (b *BGP) ExportReceivedJSON(w io.Writer) error {
+	b.mu.Lock()
+	rib := make(map[string]MsgUpdate, len(b.adjRibIn))
+	for k, v := range b.adjRibIn {
+		rib[k] = v
+	}
+	b.mu.Unlock()
+
+	if err := json.NewEncoder(w).Encode(rib); err != nil {
+		return fmt.Errorf("ExportReceivedJSON: %v", err)
+	}
+	return nil
+}
+
+/*
+	Return the received prefixes carrying the community
+*/
+func (b *BGP) ReceivedByCommunity(c uint32) []string {
+	return b.receivedBy(func(m MsgUpdate) bool {
+		return hasCommunity(m.Communities, c)
+	})
+}
+
+/*
+	Return the received prefixes originated by the AS
+*/
+func (b *BGP) ReceivedByOriginAS(as uint32) []string {
+	return b.receivedBy(func(m MsgUpdate) bool {
+		return b.originAS(m.AsPath) == as
+	})
+}
+
+/*
+	Return the received prefixes with the next hop
+*/
+func (b *BGP) ReceivedByNextHop(nh string) []string {
+	return b.receivedBy(func(m MsgUpdate) bool {
+		for _, v := range m.NextHops {
+			if v == nh {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+/*
+	Return the sorted prefixes of the Adj-RIB-In matching the predicate
+*/
+func (b *BGP) receivedBy(f func(m MsgUpdate) bool) (ret []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for p, m := range b.adjRibIn {
+		if f(m) {
+			ret = append(ret, p)
+		}
+	}
+	sort.Strings(ret)
+	return
+}
+
+/*
+	Remove all routes received from the peer, used when the session goes down
+*/
+func (b *BGP) clearAdjRibIn() {
+	b.mu.Lock()
+	b.adjRibIn = make(map[string]MsgUpdate)
+	b.imported = make(map[string]bool)
+	b.thresholdsCrossed = make(map[int]bool)
+	b.mu.Unlock()
+}
+
+/*
+	Return copy of the update carrying only the single prefix
+*/
+func singlePrefix(u MsgUpdate, p string) MsgUpdate {
+	u.Withdrawns = nil
+	u.Prefixes = []string{p}
+	u.FlowSpec = nil
+	u.FlowSpecWithdrawns = nil
+	return u
+}
@@ -0,0 +1,182 @@
+package gobgp
+
+import (
+	"reflect"
+	"sort"
+)
+
+/*
+	Create the route server, RFC 7947. The routes received from each client
+	are advertised to the other clients with the AS path and the next hop
+	unchanged, the AS of the route server is not prepended. The prefixes
+	advertised to the clients are managed by the route server.
+*/
+func NewRouteServer() *Speaker {
+	s := NewSpeaker()
+	s.routeServer = true
+	return s
+}
+
+/*
+	Return the update handler of the client passing the received routes
+	to the route server before the application handler
+*/
+func (s *Speaker) reflectHandler(peer string, uf func(m MsgUpdate)) func(m MsgUpdate) {
+	return func(m MsgUpdate) {
+		s.reflect(peer, m)
+		if uf != nil {
+			uf(m)
+		}
+	}
+}
+
+/*
+	Store the routes received from the client and advertise the changes
+	to the other clients
+*/
+func (s *Speaker) reflect(source string, u MsgUpdate) {
+	s.rsMu.Lock()
+	defer s.rsMu.Unlock()
+
+	var changed []string
+	for _, p := range u.Withdrawns {
+		if routes, ok := s.rib[p]; ok {
+			delete(routes, source)
+			if len(routes) == 0 {
+				delete(s.rib, p)
+			}
+			changed = append(changed, p)
+		}
+	}
+	for _, p := range u.Prefixes {
+		if s.rib[p] == nil {
+			s.rib[p] = make(map[string]MsgUpdate)
+		}
+		m := singlePrefix(u, p)
+		m.PathID = 0
+		m.ValidationState = ValidationNone
+		s.rib[p][source] = m
+		changed = append(changed, p)
+	}
+	s.advertiseRoutes(changed)
+}
+
+/*
+	Remove all routes received from the client after its session went down
+*/
+func (s *Speaker) clientDown(source string) {
+	s.rsMu.Lock()
+	defer s.rsMu.Unlock()
+
+	var changed []string
+	for p, routes := range s.rib {
+		if _, ok := routes[source]; ok {
+			delete(routes, source)
+			if len(routes) == 0 {
+				delete(s.rib, p)
+			}
+			changed = append(changed, p)
+		}
+	}
+	s.advertiseRoutes(changed)
+}
+
+/*
+	Advertise the best routes of the prefixes to all clients, the prefixes
+	without any route are withdrawn
+*/
+func (s *Speaker) advertiseRoutes(prefixes []string) {
+	if len(prefixes) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	peers := make(map[string]*BGP, len(s.peers))
+	for k, v := range s.peers {
+		peers[k] = v
+	}
+	s.mu.Unlock()
+
+	for addr, b := range peers {
+		for _, p := range prefixes {
+			if m, ok := s.bestRoute(p, addr, b); ok {
+				if err := b.advertise(m); err != nil {
+					b.reportError("advertiseRoutes", err)
+				}
+			} else if b.Exists(p) {
+				if err := b.Del(p); err != nil {
+					b.reportError("advertiseRoutes", err)
+				}
+			}
+		}
+	}
+}
+
+/*
+	Return the route of the prefix advertised to the client, the routes
+	received from the client itself and the routes rejected by its export
+	policy are skipped. The shortest AS path wins, the lowest address
+	of the source breaks the ties.
+*/
+func (s *Speaker) bestRoute(prefix, client string, b *BGP) (ret MsgUpdate, ok bool) {
+	routes := s.rib[prefix]
+	var sources []string
+	for k, m := range routes {
+		if k != client && b.exportAllowed(prefix, m) {
+			sources = append(sources, k)
+		}
+	}
+	sort.Strings(sources)
+
+	best := -1
+	for _, v := range sources {
+		m := routes[v]
+		l := len(m.AsPath.Path)
+		if len(m.AsPath.Set) > 0 {
+			l++
+		}
+		if best < 0 || l < best {
+			ret, ok, best = m, true, l
+		}
+	}
+	return
+}
+
+/*
+	Advertise all routes of the route server to the new client
+*/
+func (s *Speaker) syncClient(client string, b *BGP) {
+	s.rsMu.Lock()
+	defer s.rsMu.Unlock()
+
+	for p := range s.rib {
+		if m, ok := s.bestRoute(p, client, b); ok {
+			if err := b.advertise(m); err != nil {
+				b.reportError("syncClient", err)
+			}
+		}
+	}
+}
+
+/*
+	Store the route of the prefix replacing the previous one and send it
+	to the BGP peer, used by the route server
+*/
+func (b *BGP) advertise(m MsgUpdate) error {
+	p := m.Prefixes[0]
+	if _, err := marshalMessageUpdate(m, b.validationParams()); err != nil {
+		return err
+	}
+	now := b.clock.Now()
+	b.mu.Lock()
+	if old, ok := b.db[p]; ok && reflect.DeepEqual(old, m) {
+		b.mu.Unlock()
+		return nil
+	}
+	b.db[p] = m
+	b.trie.insert(p)
+	b.advertised[p] = now
+	b.mu.Unlock()
+	b.debug("Advertising prefix %s", p)
+	return b.sendUpdate(m)
+}
@@ -0,0 +1,80 @@
+package gobgp
+
+import (
+	"errors"
+)
+
+/*
+	Returned when the send queue is full and the caller is not blocked
+*/
+var ErrSendQueueFull = errors.New("Send queue full")
+
+/*
+	Pass the update to the send queue if enabled, write it immediately otherwise.
+	The caller is blocked on the full queue only while running, nothing would
+	drain the queue otherwise.
+*/
+func (b *BGP) queueUpdate(m MsgUpdate) error {
+	if b.sendQueue == nil {
+		return b.writeUpdate(m)
+	}
+
+	select {
+	case b.sendQueue <- m:
+		return nil
+	default:
+	}
+
+	if !b.sendQueueBlock || !b.running {
+		b.mu.Lock()
+		b.stats.RejectedUpdates++
+		b.mu.Unlock()
+		return ErrSendQueueFull
+	}
+
+	b.mu.Lock()
+	b.stats.BlockedUpdates++
+	b.mu.Unlock()
+	select {
+	case b.sendQueue <- m:
+		return nil
+	case <-b.stopping:
+		return errors.New("queueUpdate: Not running")
+	}
+}
+
+/*
+	Write the queued updates to the BGP peer, the updates queued
+	before the stop are written before exiting
+*/
+func (b *BGP) sendQueueWriter() {
+	defer close(b.sendQueueDone)
+	for {
+		select {
+		case m := <-b.sendQueue:
+			b.writeQueued(m)
+		case <-b.stopping:
+			for {
+				select {
+				case m := <-b.sendQueue:
+					b.writeQueued(m)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (b *BGP) writeQueued(m MsgUpdate) {
+	if err := b.writeUpdate(m); err != nil {
+		b.reportError("sendQueueWriter", err)
+	}
+}
+
+/*
+	Return the number of updates waiting in the send queue
+*/
+func (b *BGP) SendQueueDepth() int {
+	return len(b.sendQueue)
+}
@@ -0,0 +1,68 @@
+package gobgp
+
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+	Maximal length of the shutdown communication message, RFC 8203
+*/
+const shutdownMessageMax = 128
+
+/*
+	Delay between the withdrawals and the notification, gives the peer time
+	to process the withdrawals before the session goes down
+*/
+const shutdownWithdrawDelay = time.Second
+
+/*
+	Withdraw all advertised prefixes, send the Administrative Shutdown
+	notification with the optional shutdown communication message and stop
+	the BGP instance. The message is UTF-8 encoded, up to 128 bytes, RFC 8203.
+*/
+func (b *BGP) Shutdown(msg string) error {
+	if !b.running {
+		return fmt.Errorf("Shutdown: Not running")
+	}
+	if len(msg) > shutdownMessageMax {
+		return fmt.Errorf("Shutdown: Message too long, %d bytes", len(msg))
+	}
+	if !utf8.ValidString(msg) {
+		return fmt.Errorf("Shutdown: Message is not valid UTF-8")
+	}
+
+	/*
+		From now on the announcements are dropped, the collected withdrawals
+		are flushed before withdrawing the rest, regardless of the pause
+	*/
+	b.mu.Lock()
+	b.shuttingDown = true
+	b.mu.Unlock()
+
+	if b.State() == StateEstablished {
+		if err := b.Flush(); err != nil {
+			b.reportError("Shutdown", err)
+		}
+		if err := b.withdrawAll(); err != nil {
+			b.reportError("Shutdown", err)
+		}
+		b.sleep(shutdownWithdrawDelay)
+	}
+
+	b.debug("%s: Shutting down the session", b.peer)
+	if b.conn != nil {
+		var data string
+		if len(msg) > 0 {
+			data = string([]byte{byte(len(msg))}) + msg
+		}
+		// Cease, Administrative Shutdown
+		if err := b.sendNotification(6, 2, data); err != nil {
+			b.reportError("Shutdown", err)
+		}
+	}
+	b.stop()
+
+	return nil
+}
@@ -0,0 +1,333 @@
+package gobgp
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+/*
+	BGP speaker with sessions to multiple peers
+*/
+type Speaker struct {
+	/*
+		Sessions by the peer address
+	*/
+	peers map[string]*BGP
+
+	/*
+		Addresses of the peers being added, reserved until connected
+	*/
+	adding map[string]bool
+
+	/*
+		Peer groups by the name
+	*/
+	groups map[string]*PeerGroup
+
+	/*
+		Reflect the routes between the peers, RFC 7947
+	*/
+	routeServer bool
+
+	/*
+		Routes received by the route server, by the prefix and the client
+	*/
+	rib map[string]map[string]MsgUpdate
+
+	/*
+		Serializes the route server changes
+	*/
+	rsMu sync.Mutex
+
+	mu sync.Mutex
+}
+
+/*
+	Group of peers sharing the configuration and the advertised prefixes
+*/
+type PeerGroup struct {
+	/*
+		Name of the group
+	*/
+	name string
+
+	/*
+		Configuration shared by the members, the peer address is set per member
+	*/
+	config BgpConfig
+
+	/*
+		Speaker the group belongs to
+	*/
+	speaker *Speaker
+
+	/*
+		Members of the group
+	*/
+	peers []*BGP
+
+	/*
+		Prefixes advertised to all members
+	*/
+	db map[string]MsgUpdate
+
+	mu sync.Mutex
+}
+
+func NewSpeaker() *Speaker {
+	return &Speaker{peers: make(map[string]*BGP), adding: make(map[string]bool), groups: make(map[string]*PeerGroup), rib: make(map[string]map[string]MsgUpdate)}
+}
+
+/*
+	Create the session to the peer and connect to it, the peer is the client
+	of the route server if the speaker is one
+*/
+func (s *Speaker) AddPeer(c BgpConfig, uf func(m MsgUpdate)) (*BGP, error) {
+	peer := c.Peer
+	s.mu.Lock()
+	if _, e := s.peers[peer]; e || s.adding[peer] {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("AddPeer: Peer %s alredy exists", peer)
+	}
+	s.adding[peer] = true
+	s.mu.Unlock()
+
+	b, err := s.addPeer(peer, c, uf)
+
+	s.mu.Lock()
+	delete(s.adding, peer)
+	if err == nil {
+		s.peers[peer] = b
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("AddPeer: %w", err)
+	}
+
+	if s.routeServer {
+		s.syncClient(peer, b)
+	}
+
+	return b, nil
+}
+
+/*
+	Create the session to the reserved peer address and connect to it
+*/
+func (s *Speaker) addPeer(peer string, c BgpConfig, uf func(m MsgUpdate)) (*BGP, error) {
+	if s.routeServer {
+		c.DisableASPrepend = true
+		uf = s.reflectHandler(peer, uf)
+	}
+
+	b, err := New(c, uf)
+	if err != nil {
+		return nil, err
+	}
+	if s.routeServer {
+		b.onStateChange = func(from, to State) {
+			if from == StateEstablished {
+				go s.clientDown(peer)
+			}
+		}
+	}
+	if err := b.Connect(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+/*
+	Return the session to the peer, nil if not found
+*/
+func (s *Speaker) Peer(addr string) *BGP {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peers[addr]
+}
+
+/*
+	Return the number of Established sessions
+*/
+func (s *Speaker) ReadyPeers() (n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.peers {
+		if b.Ready() {
+			n++
+		}
+	}
+	return
+}
+
+/*
+	Return the sorted addresses of the peers in the Established state
+*/
+func (s *Speaker) EstablishedPeers() (ret []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for addr, b := range s.peers {
+		if b.State() == StateEstablished {
+			ret = append(ret, addr)
+		}
+	}
+	sort.Strings(ret)
+	return
+}
+
+/*
+	Return the state of the session to the peer, false if not found
+*/
+func (s *Speaker) PeerState(addr string) (State, bool) {
+	b := s.Peer(addr)
+	if b == nil {
+		return StateIdle, false
+	}
+	return b.State(), true
+}
+
+/*
+	Suppress the outbound updates to the peer, see BGP.Pause
+*/
+func (s *Speaker) PausePeer(addr string, withdraw bool) error {
+	b := s.Peer(addr)
+	if b == nil {
+		return fmt.Errorf("PausePeer: Peer %s not found", addr)
+	}
+	return b.Pause(withdraw)
+}
+
+/*
+	Resume the outbound updates to the peer, see BGP.Resume
+*/
+func (s *Speaker) ResumePeer(addr string) error {
+	b := s.Peer(addr)
+	if b == nil {
+		return fmt.Errorf("ResumePeer: Peer %s not found", addr)
+	}
+	return b.Resume()
+}
+
+/*
+	Create the group of peers sharing the configuration, the Peer
+	of the configuration is ignored
+*/
+func (s *Speaker) AddPeerGroup(name string, c BgpConfig) (*PeerGroup, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, e := s.groups[name]; e {
+		return nil, fmt.Errorf("AddPeerGroup: Group %s alredy exists", name)
+	}
+	g := &PeerGroup{name: name, config: c, speaker: s, db: make(map[string]MsgUpdate)}
+	s.groups[name] = g
+	return g, nil
+}
+
+/*
+	Disconnect all sessions
+*/
+func (s *Speaker) Close() {
+	s.mu.Lock()
+	peers := s.peers
+	s.peers = make(map[string]*BGP)
+	s.groups = make(map[string]*PeerGroup)
+	s.mu.Unlock()
+
+	s.rsMu.Lock()
+	s.rib = make(map[string]map[string]MsgUpdate)
+	s.rsMu.Unlock()
+
+	for _, b := range peers {
+		if err := b.Disconnect(); err != nil {
+			b.reportError("Close", err)
+		}
+	}
+}
+
+/*
+	Add the peer to the group, the peer inherits the group configuration
+	except for the address and the transport. TCP MD5 signatures are not
+	provided by the library, a transport providing them can be set per peer,
+	the group transport is used if nil.
+*/
+func (g *PeerGroup) AddPeer(peer string, t Transport, uf func(m MsgUpdate)) (*BGP, error) {
+	c := g.config
+	c.Peer = peer
+	if t != nil {
+		c.Transport = t
+	}
+
+	b, err := g.speaker.AddPeer(c, uf)
+	if err != nil {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	g.peers = append(g.peers, b)
+	var routes []MsgUpdate
+	for _, m := range g.db {
+		routes = append(routes, m)
+	}
+	g.mu.Unlock()
+
+	for _, m := range routes {
+		if err := b.add(m); err != nil {
+			b.reportError("AddPeer", err)
+		}
+	}
+
+	return b, nil
+}
+
+/*
+	Add prefix to all members of the group and to the members added later
+*/
+func (g *PeerGroup) Add(p string, o Origin, a TypeAsPath, n []string) error {
+	m := MsgUpdate{Prefixes: []string{p}, Origin: o, AsPath: a, NextHops: n}
+	/*
+		Members may be iBGP peers, the AS path is checked per member
+	*/
+	if _, err := marshalMessageUpdate(m, sessionParams{IBGP: true}); err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	if _, e := g.db[p]; e {
+		g.mu.Unlock()
+		return fmt.Errorf("Add: Prefix %s alredy exists", p)
+	}
+	g.db[p] = m
+	peers := append([]*BGP(nil), g.peers...)
+	g.mu.Unlock()
+
+	var err error
+	for _, b := range peers {
+		if e := b.add(m); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+/*
+	Delete prefix from all members of the group
+*/
+func (g *PeerGroup) Del(p string) error {
+	g.mu.Lock()
+	if _, e := g.db[p]; !e {
+		g.mu.Unlock()
+		return fmt.Errorf("Del: Prefix %s not found", p)
+	}
+	delete(g.db, p)
+	peers := append([]*BGP(nil), g.peers...)
+	g.mu.Unlock()
+
+	var err error
+	for _, b := range peers {
+		if e := b.Del(p); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
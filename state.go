@@ -0,0 +1,138 @@
+package gobgp
+
+import (
+	"time"
+)
+
+/*
+	Number of state transitions kept in the history
+*/
+const transitionHistoryLength = 64
+
+/*
+	States of the BGP finite state machine as defined in RFC 4271, section 8
+*/
+type State uint8
+
+const (
+	StateIdle State = iota
+	StateConnect
+	StateActive
+	StateOpenSent
+	StateOpenConfirm
+	StateEstablished
+)
+
+var stateNames = map[State]string{
+	StateIdle:        "Idle",
+	StateConnect:     "Connect",
+	StateActive:      "Active",
+	StateOpenSent:    "OpenSent",
+	StateOpenConfirm: "OpenConfirm",
+	StateEstablished: "Established",
+}
+
+func (s State) String() string {
+	if n, ok := stateNames[s]; ok {
+		return n
+	}
+	return "Unknown"
+}
+
+/*
+	Single transition of the BGP finite state machine
+*/
+type Transition struct {
+	From   State
+	To     State
+	At     time.Time
+	Reason string
+}
+
+/*
+	Return the current state of the BGP session
+*/
+func (b *BGP) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+/*
+	Check whether the session is Established
+*/
+func (b *BGP) Ready() bool {
+	return b.State() == StateEstablished
+}
+
+/*
+	Change the state of the BGP session for the reason
+*/
+func (b *BGP) setState(s State, reason string) {
+	b.mu.Lock()
+	old := b.state
+	b.state = s
+	if old != s {
+		now := b.clock.Now()
+		b.transitions[b.transitionNext] = Transition{From: old, To: s, At: now, Reason: reason}
+		b.transitionNext = (b.transitionNext + 1) % transitionHistoryLength
+		if s == StateEstablished {
+			b.established = now
+		} else if old == StateEstablished {
+			b.established = time.Time{}
+		}
+	}
+	b.mu.Unlock()
+
+	if old == s {
+		return
+	}
+	b.debug("%s: State changed from %s to %s: %s", b.peer, old, s, reason)
+	if b.onStateChange != nil {
+		b.onStateChange(old, s)
+	}
+	b.emit(Event{Type: EventState, State: s})
+}
+
+/*
+	Return how long the session has been Established, zero if it is not
+*/
+func (b *BGP) Uptime() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.established.IsZero() {
+		return 0
+	}
+	return b.clock.Now().Sub(b.established)
+}
+
+/*
+	Return how many times the session went down from Established within
+	the window, only the recent transitions kept in the history are counted
+*/
+func (b *BGP) FlapCount(window time.Duration) (n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	since := b.clock.Now().Add(-window)
+	for _, t := range b.transitions {
+		if t.From == StateEstablished && t.At.After(since) {
+			n++
+		}
+	}
+	return
+}
+
+/*
+	Return the recent state transitions kept in the history, the oldest first
+*/
+func (b *BGP) TransitionLog() (ret []Transition) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := 0; i < transitionHistoryLength; i++ {
+		t := b.transitions[(b.transitionNext+i)%transitionHistoryLength]
+		if !t.At.IsZero() {
+			ret = append(ret, t)
+		}
+	}
+	return
+}
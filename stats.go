@@ -0,0 +1,64 @@
+package gobgp
+
+/*
+	Runtime statistics of the BGP instance
+*/
+type Stats struct {
+	/*
+		Number of received prefixes dropped because of an AS path loop
+	*/
+	LoopedPrefixes uint64
+
+	/*
+		Number of events dropped because the queue was full
+	*/
+	DroppedEvents uint64
+
+	/*
+		Number of updates rejected because the send queue was full
+	*/
+	RejectedUpdates uint64
+
+	/*
+		Number of updates which blocked the caller because the send queue
+		was full
+	*/
+	BlockedUpdates uint64
+
+	/*
+		Hold time advertised by the peer and the negotiated one in seconds
+	*/
+	PeerHoldTime       uint16
+	NegotiatedHoldTime uint16
+
+	/*
+		AS number and BGP identifier of the peer
+	*/
+	PeerAS       uint32
+	PeerRouterID string
+}
+
+/*
+	Return a snapshot of the runtime statistics together with the parameters
+	received in the OPEN message of the peer
+*/
+func (b *BGP) Stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.stats
+	s.PeerHoldTime = b.peerHold
+	s.NegotiatedHoldTime = b.negotiatedHold
+	s.PeerAS = b.peerAS
+	s.PeerRouterID = b.peerID
+	return s
+}
+
+/*
+	Return the AS number of the peer, the 4-octet AS number of the capability
+	if advertised, zero before the OPEN message is received
+*/
+func (b *BGP) PeerAS() uint32 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.peerAS
+}
@@ -0,0 +1,163 @@
+package gobgp
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+/*
+	Default interval of the connection attempts, RFC 4271
+*/
+const defaultConnectRetryTime = 120 * time.Second
+
+/*
+	Timer of the session FSM, RFC 4271 section 8, driven by the Clock.
+	The timer of zero duration is stopped.
+*/
+type fsmTimer struct {
+	clock Clock
+
+	/*
+		Duration of the timer
+	*/
+	duration time.Duration
+
+	/*
+		Time of the expiry, zero while stopped
+	*/
+	deadline time.Time
+
+	/*
+		Signals the change of the deadline to the waiting goroutine
+	*/
+	changed chan struct{}
+
+	mu sync.Mutex
+}
+
+func newFSMTimer(c Clock, d time.Duration) *fsmTimer {
+	t := &fsmTimer{clock: c, duration: d, changed: make(chan struct{}, 1)}
+	t.Reset()
+	return t
+}
+
+/*
+	Restart the timer with its duration
+*/
+func (t *fsmTimer) Reset() {
+	t.mu.Lock()
+	if t.duration > 0 {
+		t.deadline = t.clock.Now().Add(t.duration)
+	} else {
+		t.deadline = time.Time{}
+	}
+	t.mu.Unlock()
+	t.notify()
+}
+
+/*
+	Change the duration and restart the timer, zero stops it
+*/
+func (t *fsmTimer) Set(d time.Duration) {
+	t.mu.Lock()
+	t.duration = d
+	t.mu.Unlock()
+	t.Reset()
+}
+
+/*
+	Stop the timer until the next Reset or Set
+*/
+func (t *fsmTimer) Stop() {
+	t.mu.Lock()
+	t.deadline = time.Time{}
+	t.mu.Unlock()
+	t.notify()
+}
+
+func (t *fsmTimer) notify() {
+	select {
+	case t.changed <- struct{}{}:
+	default:
+	}
+}
+
+/*
+	Wait for the expiry of the timer, returns false if stopped by the channel.
+	The expired timer is stopped until the next Reset or Set.
+*/
+func (t *fsmTimer) Wait(stop <-chan struct{}) bool {
+	for {
+		t.mu.Lock()
+		deadline := t.deadline
+		t.mu.Unlock()
+
+		var expiry <-chan time.Time
+		if !deadline.IsZero() {
+			d := deadline.Sub(t.clock.Now())
+			if d <= 0 {
+				t.Stop()
+				return true
+			}
+			expiry = t.clock.After(d)
+		}
+
+		select {
+		case <-expiry:
+		case <-t.changed:
+		case <-stop:
+			return false
+		}
+	}
+}
+
+/*
+	Configure the keepalive and hold timers by the negotiated hold time,
+	both are stopped if it is zero
+*/
+func (b *BGP) startSessionTimers(hold uint16) {
+	h := time.Duration(hold) * time.Second
+	k := h / 3
+	if b.keepaliveTime > 0 && b.keepaliveTime < k {
+		// Application specified
+		k = b.keepaliveTime
+	}
+	b.keepaliveTimer.Set(k)
+	b.holdTimer.Set(h)
+}
+
+/*
+	Stop the keepalive and hold timers, used when the session goes down
+*/
+func (b *BGP) stopSessionTimers() {
+	b.keepaliveTimer.Set(0)
+	b.holdTimer.Set(0)
+}
+
+/*
+	Send the KEEPALIVE message to the BGP peer on each expiry of the keepalive timer,
+	by default 1/3 of the negotiated hold time, no KEEPALIVE messages are sent
+	while the negotiated hold time is zero
+*/
+func (b *BGP) keepalive() {
+	for b.keepaliveTimer.Wait(b.stopping) {
+		b.keepaliveTimer.Reset()
+		go b.sendKeepalive()
+	}
+}
+
+/*
+	Tear the session down by the Hold Timer Expired notification when no
+	message was received from the peer within the negotiated hold time
+*/
+func (b *BGP) holdWatchdog() {
+	for b.holdTimer.Wait(b.stopping) {
+		b.reportError(b.peer+": holdWatchdog", errors.New("Hold timer expired"))
+		// Hold Timer Expired
+		if err := b.sendNotification(4, 0, ""); err != nil {
+			b.reportError("holdWatchdog", err)
+		}
+		b.disconnect("Hold timer expired")
+	}
+}
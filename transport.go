@@ -0,0 +1,223 @@
+package gobgp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Transport carrying the BGP sessions, allows to run BGP over other
+	substrates than plain TCP
+*/
+type Transport interface {
+	/*
+		Connect to the peer at the address:port
+	*/
+	Dial(addr string) (io.ReadWriteCloser, error)
+
+	/*
+		Listen for inbound sessions on the address:port
+	*/
+	Listen(addr string) (Listener, error)
+}
+
+/*
+	Listener of inbound sessions created by the Transport
+*/
+type Listener interface {
+	Accept() (io.ReadWriteCloser, error)
+	Close() error
+}
+
+/*
+	Default timeout of the TLS handshake
+*/
+const defaultTLSHandshakeTimeout = 10 * time.Second
+
+/*
+	Connections supporting the write timeout
+*/
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+/*
+	Transport over TCP, the default one
+*/
+type TCPTransport struct {
+	/*
+		Local IP address to connect from, any if empty
+	*/
+	LocalAddress string
+}
+
+func (t TCPTransport) Dial(addr string) (io.ReadWriteCloser, error) {
+	var d net.Dialer
+	if len(t.LocalAddress) > 0 {
+		ip := net.ParseIP(t.LocalAddress)
+		if ip == nil {
+			return nil, fmt.Errorf("Dial: Invalid local address")
+		}
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	return d.Dial("tcp", addr)
+}
+
+func (t TCPTransport) Listen(addr string) (Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return netListener{l}, nil
+}
+
+/*
+	Listener wrapping the net.Listener
+*/
+type netListener struct {
+	l net.Listener
+}
+
+func (l netListener) Accept() (io.ReadWriteCloser, error) {
+	return l.l.Accept()
+}
+
+func (l netListener) Close() error {
+	return l.l.Close()
+}
+
+/*
+	Transport wrapping the connections of another transport in TLS
+
+	This is an experimental non-standard transport (not RFC BGP-over-TLS),
+	the BGP handshake and framing above it are unchanged
+*/
+type TLSTransport struct {
+	/*
+		Underlying transport, TCP if nil
+	*/
+	Transport Transport
+
+	/*
+		TLS configuration, the server name defaults to the peer address
+	*/
+	Config *tls.Config
+
+	/*
+		Timeout of the TLS handshake of the outbound connections,
+		defaults to 10 seconds
+	*/
+	HandshakeTimeout time.Duration
+}
+
+func (t TLSTransport) Dial(addr string) (io.ReadWriteCloser, error) {
+	c, err := t.underlying().Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := t.config()
+	if len(conf.ServerName) == 0 && !conf.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		conf.ServerName = host
+	}
+
+	nc, ok := c.(net.Conn)
+	if !ok {
+		c.Close()
+		return nil, fmt.Errorf("Dial: TLS requires a net.Conn transport")
+	}
+
+	timeout := t.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = defaultTLSHandshakeTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	tc := tls.Client(nc, conf)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		tc.Close()
+		return nil, err
+	}
+
+	return tc, nil
+}
+
+func (t TLSTransport) Listen(addr string) (Listener, error) {
+	l, err := t.underlying().Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return tlsListener{l: l, config: t.config()}, nil
+}
+
+func (t TLSTransport) underlying() Transport {
+	if t.Transport == nil {
+		return TCPTransport{}
+	}
+	return t.Transport
+}
+
+func (t TLSTransport) config() *tls.Config {
+	if t.Config == nil {
+		return &tls.Config{}
+	}
+	return t.Config.Clone()
+}
+
+/*
+	Listener wrapping the accepted connections in TLS
+*/
+type tlsListener struct {
+	l      Listener
+	config *tls.Config
+}
+
+func (l tlsListener) Accept() (io.ReadWriteCloser, error) {
+	for {
+		c, err := l.l.Accept()
+		if err != nil {
+			return nil, err
+		}
+		nc, ok := c.(net.Conn)
+		if !ok {
+			// TLS requires a net.Conn, the connection is refused
+			c.Close()
+			continue
+		}
+		// Handshake is performed on the first read or write
+		return tls.Server(nc, l.config), nil
+	}
+}
+
+func (l tlsListener) Close() error {
+	return l.l.Close()
+}
+
+/*
+	Sequence for naming peers of connections without a remote address
+*/
+var anonymousPeers uint64
+
+/*
+	Return the remote IP address of the connection if known
+*/
+func remoteAddress(c io.ReadWriteCloser) string {
+	if r, ok := c.(interface{ RemoteAddr() net.Addr }); ok {
+		if h, _, err := net.SplitHostPort(r.RemoteAddr().String()); err == nil {
+			return h
+		}
+		return r.RemoteAddr().String()
+	}
+	return fmt.Sprintf("peer%d", atomic.AddUint64(&anonymousPeers, 1))
+}
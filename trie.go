@@ -0,0 +1,168 @@
+package gobgp
+
+import (
+	"net"
+)
+
+/*
+	Binary prefix tree of the advertised prefixes for the longest
+	and more-specific match lookups
+*/
+type prefixTrie struct {
+	root map[uint16]*trieNode
+}
+
+type trieNode struct {
+	child  [2]*trieNode
+	prefix string
+	set    bool
+}
+
+func newPrefixTrie() *prefixTrie {
+	return &prefixTrie{root: make(map[uint16]*trieNode)}
+}
+
+/*
+	Return the bit of the address at the position
+*/
+func addressBit(n []byte, i uint8) int {
+	return int(n[i/8]>>(7-i%8)) & 1
+}
+
+/*
+	Insert the prefix, invalid prefixes are ignored
+*/
+func (t *prefixTrie) insert(p string) {
+	afi, n, m, err := parsePrefix(p)
+	if err != nil {
+		return
+	}
+	x := t.root[afi]
+	if x == nil {
+		x = &trieNode{}
+		t.root[afi] = x
+	}
+	for i := uint8(0); i < m; i++ {
+		b := addressBit(n, i)
+		if x.child[b] == nil {
+			x.child[b] = &trieNode{}
+		}
+		x = x.child[b]
+	}
+	x.prefix = p
+	x.set = true
+}
+
+/*
+	Remove the prefix, the branches left empty are pruned
+*/
+func (t *prefixTrie) remove(p string) {
+	afi, n, m, err := parsePrefix(p)
+	if err != nil {
+		return
+	}
+	x := t.root[afi]
+	path := []*trieNode{x}
+	for i := uint8(0); x != nil && i < m; i++ {
+		x = x.child[addressBit(n, i)]
+		path = append(path, x)
+	}
+	if x == nil || !x.set || x.prefix != p {
+		return
+	}
+	x.set = false
+	x.prefix = ""
+
+	for i := len(path) - 1; i > 0; i-- {
+		c := path[i]
+		if c.set || c.child[0] != nil || c.child[1] != nil {
+			break
+		}
+		path[i-1].child[addressBit(n, uint8(i-1))] = nil
+	}
+}
+
+/*
+	Return the prefixes containing the address, least specific first
+*/
+func (t *prefixTrie) covering(ip net.IP) (ret []string) {
+	afi, n := uint16(afiIPv6), ip.To16()
+	if v4 := ip.To4(); v4 != nil {
+		afi, n = afiIPv4, v4
+	}
+	if n == nil {
+		return
+	}
+	x := t.root[afi]
+	for i := uint8(0); x != nil; i++ {
+		if x.set {
+			ret = append(ret, x.prefix)
+		}
+		if int(i) == len(n)*8 {
+			break
+		}
+		x = x.child[addressBit(n, i)]
+	}
+	return
+}
+
+/*
+	Return the prefixes more specific than the prefix
+*/
+func (t *prefixTrie) moreSpecifics(p string) (ret []string) {
+	afi, n, m, err := parsePrefix(p)
+	if err != nil {
+		return
+	}
+	x := t.root[afi]
+	for i := uint8(0); x != nil && i < m; i++ {
+		x = x.child[addressBit(n, i)]
+	}
+	if x == nil {
+		return
+	}
+	for _, c := range x.child {
+		ret = c.collect(ret)
+	}
+	return
+}
+
+/*
+	Append all prefixes of the subtree
+*/
+func (x *trieNode) collect(ret []string) []string {
+	if x == nil {
+		return ret
+	}
+	if x.set {
+		ret = append(ret, x.prefix)
+	}
+	for _, c := range x.child {
+		ret = c.collect(ret)
+	}
+	return ret
+}
+
+/*
+	Return the advertised prefixes containing the IP address, least specific
+	first, and whether there is any
+*/
+func (b *BGP) Covering(ip string) ([]string, bool) {
+	a := net.ParseIP(ip)
+	if a == nil {
+		return nil, false
+	}
+	b.mu.Lock()
+	ret := b.trie.covering(a)
+	b.mu.Unlock()
+	return ret, len(ret) > 0
+}
+
+/*
+	Return the advertised prefixes more specific than the prefix
+*/
+func (b *BGP) MoreSpecifics(prefix string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.trie.moreSpecifics(prefix)
+}
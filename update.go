@@ -2,10 +2,20 @@ package gobgp
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
 )
 
+/*
+	Returned for announcements with more than one next hop, a single UPDATE
+	carries exactly one next hop, advertise ECMP sets by separate peers
+*/
+var ErrMultipleNextHops = errors.New("Multiple next hops")
+
 /*
 	Types of BGP update attributes
 */
@@ -14,17 +24,102 @@ const (
 	attributeTypeOrigin
 	attributeTypeAsPath
 	attributeTypeNextHop
+	attributeTypeMultiExitDisc
+	attributeTypeLocalPref
+	attributeTypeAtomicAggregate
+	attributeTypeAggregator
+	attributeTypeCommunities
+)
+
+/*
+	Types of multiprotocol attributes, RFC 4760
+*/
+const (
+	attributeTypeMpReachNLRI   = 14
+	attributeTypeMpUnreachNLRI = 15
+)
+
+/*
+	Type of the extended communities attribute, RFC 4360
+*/
+const attributeTypeExtendedCommunities = 16
+
+/*
+	Types of the attributes carrying the 4-octet AS numbers over the sessions
+	of the 2-octet AS speakers, RFC 6793
+*/
+const (
+	attributeTypeAs4Path       = 17
+	attributeTypeAs4Aggregator = 18
+)
+
+/*
+	Flags of BGP update attributes
+*/
+const (
+	attributeFlagExtendedLength = 0x10
+	attributeFlagPartial        = 0x20
+	attributeFlagTransitive     = 0x40
+	attributeFlagOptional       = 0x80
+)
+
+/*
+	Well-known communities
+*/
+const (
+	CommunityGracefulShutdown uint32 = 65535<<16 | 0
+	CommunityBlackhole        uint32 = 65535<<16 | 666
 )
 
+/*
+	Unspecified next hop, the receiving peer uses the address of the sender,
+	accepted as any other next hop by the route server clients
+*/
+const NextHopUnspecified = "0.0.0.0"
+
+/*
+	Maximum number of AS numbers in a single AS path segment
+*/
+const asPathSegmentMaxLength = 255
+
+/*
+	Origin of the route, RFC 4271
+*/
+type Origin uint8
+
 /*
 	Types of origin
 */
 const (
-	OriginTypeIGP = iota
+	OriginTypeIGP Origin = iota
 	OriginTypeEGP
 	OriginTypeIncomplete
 )
 
+var originNames = map[Origin]string{
+	OriginTypeIGP:        "IGP",
+	OriginTypeEGP:        "EGP",
+	OriginTypeIncomplete: "Incomplete",
+}
+
+/*
+	Return the origin in a human readable form
+*/
+func (o Origin) String() string {
+	if n, ok := originNames[o]; ok {
+		return n
+	}
+	return strconv.Itoa(int(o))
+}
+
+/*
+	Check whether the origin is one of the defined types
+*/
+func (o Origin) Valid() bool {
+	_, ok := originNames[o]
+	return ok
+}
+
 /*
 	Types of AS path
 */
@@ -35,76 +130,286 @@ const (
 )
 
 /*
-	Attribute AS path
+	Attribute AS path, ASes of the Path are of the Type, the optional Set
+	holds the trailing AS_SET of aggregated routes following a sequence.
+	The zero Type is sent as AS_SEQUENCE.
 */
 type TypeAsPath struct {
-	Type uint
-	Path []uint16
+	Type uint     `json:"type"`
+	Path []uint32 `json:"path,omitempty"`
+	Set  []uint32 `json:"set,omitempty"`
+}
+
+/*
+	Return the AS path in the usual notation, ASes of AS_SET in braces
+*/
+func (p TypeAsPath) String() string {
+	join := func(path []uint32) string {
+		var s []string
+		for _, v := range path {
+			s = append(s, strconv.FormatUint(uint64(v), 10))
+		}
+		return strings.Join(s, " ")
+	}
+
+	s := join(p.Path)
+	if p.Type == AsPathTypeSet {
+		s = "{" + s + "}"
+	}
+	if len(p.Set) > 0 {
+		if len(s) > 0 {
+			s += " "
+		}
+		s += "{" + join(p.Set) + "}"
+	}
+	return s
+}
+
+/*
+	Return copy of the AS path with the AS prepended to the sequence,
+	ASes of the path of the AS_SET type are moved to the trailing set
+*/
+func (p TypeAsPath) prepend(as uint32) TypeAsPath {
+	if p.Type == AsPathTypeSet {
+		p.Set = append(append([]uint32{}, p.Path...), p.Set...)
+		p.Path = nil
+	}
+	p.Type = AsPathTypeSequence
+	p.Path = append([]uint32{as}, p.Path...)
+	return p
+}
+
+/*
+	Attribute aggregator
+*/
+type TypeAggregator struct {
+	ASN     uint32 `json:"asn"`
+	Address string `json:"address"`
 }
 
 type MsgUpdate struct {
-	Withdrawns []string
-	Prefixes   []string
-	Origin     uint
-	AsPath     TypeAsPath
-	NextHops   []string
+	Withdrawns []string   `json:"withdrawns,omitempty"`
+	Prefixes   []string   `json:"prefixes,omitempty"`
+	Origin     Origin     `json:"origin"`
+	AsPath     TypeAsPath `json:"as_path"`
+	NextHops   []string   `json:"next_hops,omitempty"`
+
+	/*
+		Multi exit discriminator and local preference, RFC 4271, zero values
+		are not encoded, the local preference is sent to iBGP peers only
+	*/
+	MED       uint32 `json:"med,omitempty"`
+	LocalPref uint32 `json:"local_pref,omitempty"`
+
+	AtomicAggregate     bool           `json:"atomic_aggregate,omitempty"`
+	Aggregator          TypeAggregator `json:"aggregator"`
+	Communities         []uint32       `json:"communities,omitempty"`
+	ExtendedCommunities []uint64       `json:"extended_communities,omitempty"`
+	FlowSpec            []FlowSpecRule `json:"flowspec,omitempty"`
+	FlowSpecWithdrawns  []FlowSpecRule `json:"flowspec_withdrawns,omitempty"`
+
+	/*
+		Path identifier of the prefixes, encoded only if ADD-PATH
+		is negotiated, RFC 7911
+	*/
+	PathID uint32 `json:"path_id,omitempty"`
+
+	/*
+		Origin validation state of the received route, not encoded
+	*/
+	ValidationState ValidationState `json:"validation_state,omitempty"`
+
+	/*
+		Attributes present in the received update, distinguishes the absent
+		attributes from the zero ones, not encoded
+	*/
+	Present AttributeSet `json:"present,omitempty"`
+}
+
+/*
+	Set of the attributes by the type, RFC 4271
+*/
+type AttributeSet uint64
+
+/*
+	Attributes of the set
+*/
+const (
+	PresentOrigin              AttributeSet = 1 << attributeTypeOrigin
+	PresentAsPath              AttributeSet = 1 << attributeTypeAsPath
+	PresentNextHop             AttributeSet = 1 << attributeTypeNextHop
+	PresentMED                 AttributeSet = 1 << attributeTypeMultiExitDisc
+	PresentLocalPref           AttributeSet = 1 << attributeTypeLocalPref
+	PresentAtomicAggregate     AttributeSet = 1 << attributeTypeAtomicAggregate
+	PresentAggregator          AttributeSet = 1 << attributeTypeAggregator
+	PresentCommunities         AttributeSet = 1 << attributeTypeCommunities
+	PresentExtendedCommunities AttributeSet = 1 << attributeTypeExtendedCommunities
+)
+
+/*
+	Check whether all the attributes are in the set
+*/
+func (s AttributeSet) Has(a AttributeSet) bool {
+	return s&a == a
+}
+
+/*
+	Check whether the attribute of the type is in the set,
+	including the types unknown to the library
+*/
+func (s AttributeSet) HasType(t uint8) bool {
+	return t < 64 && s&(1<<t) != 0
 }
 
-func marshalMessageUpdate(m MsgUpdate) (ret []byte, err error) {
-	var n uint32
-	var mask uint8
+/*
+	Return the update in a human readable form, only the present parts are shown
+*/
+func (m MsgUpdate) String() string {
+	var s []string
+	if len(m.Withdrawns) > 0 {
+		s = append(s, fmt.Sprintf("withdraw %v", m.Withdrawns))
+	}
+	if len(m.Prefixes) > 0 {
+		s = append(s, fmt.Sprintf("announce %v", m.Prefixes))
+	}
+	if m.PathID != 0 {
+		s = append(s, fmt.Sprintf("path-id %d", m.PathID))
+	}
+	if len(m.FlowSpecWithdrawns) > 0 {
+		s = append(s, fmt.Sprintf("withdraw flowspec %+v", m.FlowSpecWithdrawns))
+	}
+	if len(m.FlowSpec) > 0 {
+		s = append(s, fmt.Sprintf("announce flowspec %+v", m.FlowSpec))
+	}
+	if len(m.Prefixes) > 0 || len(m.FlowSpec) > 0 {
+		s = append(s, "origin "+m.Origin.String())
+		s = append(s, fmt.Sprintf("as-path [%s]", m.AsPath))
+	}
+	if len(m.NextHops) > 0 {
+		s = append(s, "next-hop "+strings.Join(m.NextHops, " "))
+	}
+	if m.MED != 0 {
+		s = append(s, fmt.Sprintf("med %d", m.MED))
+	}
+	if m.LocalPref != 0 {
+		s = append(s, fmt.Sprintf("local-pref %d", m.LocalPref))
+	}
+	if m.AtomicAggregate {
+		s = append(s, "atomic-aggregate")
+	}
+	if len(m.Aggregator.Address) > 0 {
+		s = append(s, fmt.Sprintf("aggregator %d %s", m.Aggregator.ASN, m.Aggregator.Address))
+	}
+	if len(m.Communities) > 0 {
+		var c []string
+		for _, v := range m.Communities {
+			c = append(c, fmt.Sprintf("%d:%d", v>>16, v&0xffff))
+		}
+		s = append(s, "communities "+strings.Join(c, " "))
+	}
+	if len(m.ExtendedCommunities) > 0 {
+		var c []string
+		for _, v := range m.ExtendedCommunities {
+			c = append(c, fmt.Sprintf("0x%016x", v))
+		}
+		s = append(s, "extended-communities "+strings.Join(c, " "))
+	}
+	return strings.Join(s, " ")
+}
 
+func marshalMessageUpdate(m MsgUpdate, p sessionParams) (ret []byte, err error) {
 	/*
-		Withdrawn prefixes
+		Path identifier preceding each prefix if ADD-PATH is negotiated
+	*/
+	var pathID []byte
+	if p.AddPath {
+		pathID = make([]byte, 4)
+		binary.BigEndian.PutUint32(pathID, m.PathID)
+	}
+
+	/*
+		Withdrawn prefixes, carried by the MP_UNREACH_NLRI attribute
+		if negotiated
 	*/
 	bufW := make([]byte, 2)
-	if len(m.Withdrawns) > 0 {
-		binary.BigEndian.PutUint16(bufW[0:2], uint16(len(m.Withdrawns)*5))
+	if len(m.Withdrawns) > 0 && !p.MPReach {
 		for _, v := range m.Withdrawns {
-			n, mask, err = parsePrefix(v)
+			var x []byte
+			x, err = encodeNLRI(v)
 			if err != nil {
 				return
 			}
-			buf := make([]byte, 5)
-			buf[0] = mask
-			binary.BigEndian.PutUint32(buf[1:], n)
-			bufW = append(bufW, buf...)
+			bufW = append(bufW, pathID...)
+			bufW = append(bufW, x...)
 		}
+		binary.BigEndian.PutUint16(bufW[0:2], uint16(len(bufW)-2))
 	}
 
 	/*
 		Attributes
 	*/
-	bufA := make([]byte, 2)
-	if len(m.Prefixes) > 0 {
-		bufOrigin := []byte{0x40, attributeTypeOrigin, 1, byte(m.Origin)}
-		bufA = append(bufA, bufOrigin...)
+	var attrs [][]byte
+	if (len(m.Withdrawns) > 0 && p.MPReach) || len(m.FlowSpecWithdrawns) > 0 {
+		var bufMP []byte
+		if len(m.FlowSpecWithdrawns) > 0 {
+			if len(m.Withdrawns) > 0 && p.MPReach {
+				err = fmt.Errorf("Flow specification mixed with prefixes")
+				return
+			}
+			bufMP, err = marshalFlowSpecMpNLRI(m.FlowSpecWithdrawns)
+		} else {
+			bufMP, err = marshalMpNLRI(m.Withdrawns, pathID)
+		}
+		if err != nil {
+			return
+		}
+		attrs = append(attrs, marshalAttribute(attributeFlagOptional, attributeTypeMpUnreachNLRI, bufMP))
+	}
+	if len(m.Prefixes) > 0 || len(m.FlowSpec) > 0 {
+		if !m.Origin.Valid() {
+			err = fmt.Errorf("Invalid origin %d", m.Origin)
+			return
+		}
+		attrs = append(attrs, marshalAttribute(attributeFlagTransitive, attributeTypeOrigin, []byte{byte(m.Origin)}))
 
-		if len(m.AsPath.Path) == 0 {
+		/*
+			Locally originated routes default to the AS_SEQUENCE
+		*/
+		switch m.AsPath.Type {
+		case 0:
+			m.AsPath.Type = AsPathTypeSequence
+		case AsPathTypeSet, AsPathTypeSequence:
+		default:
+			err = fmt.Errorf("Invalid AS path segment type %d", m.AsPath.Type)
+			return
+		}
+
+		if p.PrependAS != 0 {
+			m.AsPath = m.AsPath.prepend(p.PrependAS)
+		}
+
+		/*
+			Locally originated routes and flow specification are advertised
+			with the empty AS path, the attribute of zero length, to iBGP peers
+		*/
+		if len(m.AsPath.Path) == 0 && len(m.AsPath.Set) == 0 && len(m.Prefixes) > 0 && !p.IBGP {
 			err = fmt.Errorf("Empty AS path")
 			return
 		}
-		bufAsPath := make([]byte, 5)
-		bufAsPath[0] = 0x40
-		bufAsPath[1] = attributeTypeAsPath
-		bufAsPath[3] = byte(m.AsPath.Type)
-		bufAsPath[4] = byte(len(m.AsPath.Path))
-		a := make([]byte, 2)
-		for _, v := range m.AsPath.Path {
-			binary.BigEndian.PutUint16(a, v)
-			bufAsPath = append(bufAsPath, a...)
+		attrs = append(attrs, marshalAttribute(attributeFlagTransitive, attributeTypeAsPath, marshalAsPath(m.AsPath, p.AS4)))
+		if !p.AS4 && m.AsPath.hasAS4() {
+			attrs = append(attrs, marshalAttribute(attributeFlagOptional|attributeFlagTransitive, attributeTypeAs4Path, marshalAsPath(m.AsPath, true)))
 		}
-		bufAsPath[2] = byte(len(m.AsPath.Path)*2 + 2)
-		bufA = append(bufA, bufAsPath...)
 
-		if len(m.NextHops) == 0 {
+		if len(m.NextHops) == 0 && len(m.Prefixes) > 0 {
 			err = fmt.Errorf("No next hop defined")
 			return
 		}
-		bufNextHop := make([]byte, 3)
-		bufNextHop[0] = 0x40
-		bufNextHop[1] = attributeTypeNextHop
-		bufNextHop[2] = byte(4 * len(m.NextHops))
+		if len(m.NextHops) > 1 {
+			err = ErrMultipleNextHops
+			return
+		}
+		var bufNextHop []byte
 		for _, v := range m.NextHops {
 			n := net.ParseIP(v).To4()
 			if n == nil {
@@ -113,30 +418,129 @@ func marshalMessageUpdate(m MsgUpdate) (ret []byte, err error) {
 			}
 			bufNextHop = append(bufNextHop, n...)
 		}
-		bufA = append(bufA, bufNextHop...)
+		if !p.MPReach && len(m.Prefixes) > 0 {
+			attrs = append(attrs, marshalAttribute(attributeFlagTransitive, attributeTypeNextHop, bufNextHop))
+		}
+
+		if m.MED != 0 {
+			bufMED := make([]byte, 4)
+			binary.BigEndian.PutUint32(bufMED, m.MED)
+			attrs = append(attrs, marshalAttribute(attributeFlagOptional, attributeTypeMultiExitDisc, bufMED))
+		}
+
+		/*
+			Local preference is sent to iBGP peers only
+		*/
+		if m.LocalPref != 0 && p.IBGP {
+			bufLocalPref := make([]byte, 4)
+			binary.BigEndian.PutUint32(bufLocalPref, m.LocalPref)
+			attrs = append(attrs, marshalAttribute(attributeFlagTransitive, attributeTypeLocalPref, bufLocalPref))
+		}
+
+		if m.AtomicAggregate {
+			attrs = append(attrs, marshalAttribute(attributeFlagTransitive, attributeTypeAtomicAggregate, nil))
+		}
+
+		if len(m.Aggregator.Address) > 0 {
+			n := net.ParseIP(m.Aggregator.Address).To4()
+			if n == nil {
+				err = fmt.Errorf("Invalid aggregator address %s", m.Aggregator.Address)
+				return
+			}
+			bufAggregator := marshalAS(m.Aggregator.ASN, p.AS4)
+			bufAggregator = append(bufAggregator, n...)
+			attrs = append(attrs, marshalAttribute(attributeFlagOptional|attributeFlagTransitive, attributeTypeAggregator, bufAggregator))
+			if !p.AS4 && m.Aggregator.ASN > 0xffff {
+				bufAs4Aggregator := marshalAS(m.Aggregator.ASN, true)
+				bufAs4Aggregator = append(bufAs4Aggregator, n...)
+				attrs = append(attrs, marshalAttribute(attributeFlagOptional|attributeFlagTransitive, attributeTypeAs4Aggregator, bufAs4Aggregator))
+			}
+		}
+
+		if len(m.Communities) > 0 {
+			bufCommunities := make([]byte, 4*len(m.Communities))
+			for i, v := range m.Communities {
+				binary.BigEndian.PutUint32(bufCommunities[4*i:], v)
+			}
+			attrs = append(attrs, marshalAttribute(attributeFlagOptional|attributeFlagTransitive, attributeTypeCommunities, bufCommunities))
+		}
+
+		if (p.MPReach && len(m.Prefixes) > 0) || len(m.FlowSpec) > 0 {
+			var bufNLRI []byte
+			if len(m.FlowSpec) > 0 {
+				if p.MPReach && len(m.Prefixes) > 0 {
+					err = fmt.Errorf("Flow specification mixed with prefixes")
+					return
+				}
+				/*
+					Flow specification has no next hop
+				*/
+				bufNextHop = nil
+				bufNLRI, err = marshalFlowSpecMpNLRI(m.FlowSpec)
+			} else {
+				bufNLRI, err = marshalMpNLRI(m.Prefixes, pathID)
+			}
+			if err != nil {
+				return
+			}
+			/*
+				AFI and SAFI, next hop, reserved octet and NLRI
+			*/
+			bufMP := append([]byte{}, bufNLRI[:3]...)
+			bufMP = append(bufMP, byte(len(bufNextHop)))
+			bufMP = append(bufMP, bufNextHop...)
+			bufMP = append(bufMP, 0)
+			bufMP = append(bufMP, bufNLRI[3:]...)
+			attrs = append(attrs, marshalAttribute(attributeFlagOptional, attributeTypeMpReachNLRI, bufMP))
+		}
 
-		binary.BigEndian.PutUint16(bufA[0:2], uint16(len(bufOrigin)+len(bufAsPath)+len(bufNextHop)))
+		if len(m.ExtendedCommunities) > 0 {
+			bufCommunities := make([]byte, 8*len(m.ExtendedCommunities))
+			for i, v := range m.ExtendedCommunities {
+				binary.BigEndian.PutUint64(bufCommunities[8*i:], v)
+			}
+			attrs = append(attrs, marshalAttribute(attributeFlagOptional|attributeFlagTransitive, attributeTypeExtendedCommunities, bufCommunities))
+		}
 	}
 
 	/*
-		Announced prefixes
+		Attributes in the canonical ascending order of the type codes
+	*/
+	sort.SliceStable(attrs, func(i, j int) bool {
+		return attrs[i][1] < attrs[j][1]
+	})
+	bufA := make([]byte, 2)
+	for _, v := range attrs {
+		bufA = append(bufA, v...)
+	}
+	binary.BigEndian.PutUint16(bufA[0:2], uint16(len(bufA)-2))
+
+	/*
+		Announced prefixes, carried by the MP_REACH_NLRI attribute
+		if negotiated
 	*/
 	var bufNLRI []byte
-	for _, v := range m.Prefixes {
-		n, mask, err = parsePrefix(v)
-		if err != nil {
-			return
+	if !p.MPReach {
+		for _, v := range m.Prefixes {
+			var x []byte
+			x, err = encodeNLRI(v)
+			if err != nil {
+				return
+			}
+			bufNLRI = append(bufNLRI, pathID...)
+			bufNLRI = append(bufNLRI, x...)
 		}
-		buf := make([]byte, 5)
-		buf[0] = mask
-		binary.BigEndian.PutUint32(buf[1:], n)
-		bufNLRI = append(bufNLRI, buf...)
 	}
 
 	/*
 		Message header
 	*/
-	ret, err = marshalMessageHeader(msgTypeUpdate, len(bufW)+len(bufA)+len(bufNLRI))
+	l := len(bufW) + len(bufA) + len(bufNLRI)
+	if l+headerLength > p.maxLength() {
+		err = fmt.Errorf("%w (%d)", ErrMessageTooLong, l+headerLength)
+		return
+	}
+	ret, err = marshalMessageHeader(msgTypeUpdate, l)
 	if err != nil {
 		return
 	}
@@ -151,29 +555,311 @@ func marshalMessageUpdate(m MsgUpdate) (ret []byte, err error) {
 	return
 }
 
-func unmarshalMessageUpdate(in []byte) (ret MsgUpdate, err error) {
+/*
+	Encode the address family and the IPv4 unicast prefixes in the form
+	used by the MP_REACH_NLRI and MP_UNREACH_NLRI attributes, RFC 4760,
+	each prefix is preceded by the path identifier if not empty
+*/
+func marshalMpNLRI(prefixes []string, pathID []byte) (ret []byte, err error) {
+	ret = make([]byte, 3)
+	binary.BigEndian.PutUint16(ret[0:2], afiIPv4)
+	ret[2] = safiUnicast
+	for _, v := range prefixes {
+		var x []byte
+		x, err = encodeNLRI(v)
+		if err != nil {
+			return
+		}
+		ret = append(ret, pathID...)
+		ret = append(ret, x...)
+	}
+	return
+}
+
+/*
+	Encode the IPv4 prefix into the NLRI form, the mask length followed
+	by the minimal number of octets of the network address, RFC 4271
+*/
+func encodeNLRI(prefix string) (ret []byte, err error) {
+	afi, n, mask, err := parsePrefix(prefix)
+	if err != nil {
+		return
+	}
+	if afi != afiIPv4 {
+		err = fmt.Errorf("%w: %s", ErrUnsupportedAddressFamily, prefix)
+		return
+	}
+	ret = append([]byte{mask}, n[:(int(mask)+7)/8]...)
+	return
+}
+
+/*
+	Decode the IPv4 prefix from the NLRI form, returns the number
+	of octets consumed
+*/
+func decodeNLRI(b []byte) (prefix string, consumed int, err error) {
+	if len(b) < 1 {
+		err = fmt.Errorf("Invalid prefix encoding")
+		return
+	}
+	mask := int(b[0])
+	l := (mask + 7) / 8
+	if mask > 32 || 1+l > len(b) {
+		err = fmt.Errorf("Invalid prefix encoding")
+		return
+	}
+	a := make(net.IP, net.IPv4len)
+	copy(a, b[1:1+l])
+	n := net.IPNet{IP: a, Mask: net.CIDRMask(mask, 32)}
+	prefix = n.String()
+	consumed = 1 + l
+	return
+}
+
+/*
+	Encode the address family and the flow specification rules in the form
+	used by the MP_REACH_NLRI and MP_UNREACH_NLRI attributes, RFC 8955
+*/
+func marshalFlowSpecMpNLRI(rules []FlowSpecRule) (ret []byte, err error) {
+	ret = make([]byte, 3)
+	binary.BigEndian.PutUint16(ret[0:2], afiIPv4)
+	ret[2] = safiFlowSpec
+	for _, v := range rules {
+		var buf []byte
+		buf, err = marshalFlowSpecNLRI(v)
+		if err != nil {
+			return
+		}
+		ret = append(ret, buf...)
+	}
+	return
+}
+
+/*
+	Decode the sequence of IPv4 prefixes in the NLRI form, used by
+	the withdrawn routes, the NLRI and the multiprotocol attributes
+*/
+func unmarshalPrefixes(in []byte) (ret []string, err error) {
+	for len(in) > 0 {
+		var x string
+		var l int
+		x, l, err = decodeNLRI(in)
+		if err != nil {
+			return
+		}
+		ret = append(ret, x)
+		in = in[l:]
+	}
+	return
+}
+
+/*
+	Encode a single attribute, the extended length form is used
+	when the value does not fit into a single octet length
+*/
+func marshalAttribute(flags, t uint8, v []byte) (ret []byte) {
+	if len(v) > 255 {
+		ret = []byte{flags | attributeFlagExtendedLength, t, 0, 0}
+		binary.BigEndian.PutUint16(ret[2:4], uint16(len(v)))
+	} else {
+		ret = []byte{flags &^ attributeFlagExtendedLength, t, byte(len(v))}
+	}
+	ret = append(ret, v...)
+	return
+}
+
+/*
+	Encode the AS number in 4 octets, or in 2 octets replacing
+	numbers which do not fit by AS_TRANS
+*/
+func marshalAS(as uint32, as4 bool) (ret []byte) {
+	if as4 {
+		ret = make([]byte, 4)
+		binary.BigEndian.PutUint32(ret, as)
+		return
+	}
+	if as > 0xffff {
+		as = asTrans
+	}
+	ret = make([]byte, 2)
+	binary.BigEndian.PutUint16(ret, uint16(as))
+	return
+}
+
+/*
+	Encode the AS path attribute value, paths longer than a single segment
+	can hold are split into multiple segments of the same type
+*/
+func marshalAsPath(p TypeAsPath, as4 bool) (ret []byte) {
+	ret = marshalAsPathSegments(ret, p.Type, p.Path, as4)
+	ret = marshalAsPathSegments(ret, AsPathTypeSet, p.Set, as4)
+	return
+}
+
+func marshalAsPathSegments(ret []byte, t uint, path []uint32, as4 bool) []byte {
+	for i := 0; i < len(path); i += asPathSegmentMaxLength {
+		end := i + asPathSegmentMaxLength
+		if end > len(path) {
+			end = len(path)
+		}
+		ret = append(ret, byte(t), byte(end-i))
+		for _, v := range path[i:end] {
+			ret = append(ret, marshalAS(v, as4)...)
+		}
+	}
+	return ret
+}
+
+/*
+	Returned for the AS path with the AS_SEQUENCE following an AS_SET
+*/
+var errAsPathSegmentOrder = errors.New("AS_SEQUENCE following AS_SET not supported")
+
+/*
+	Decode the AS path attribute value, ASes of the segments of the same type
+	as the first one are joined into a single path, ASes of the AS_SET
+	segments following the sequence are joined into the set. Each segment
+	must fit into the attribute value, long paths are carried by multiple
+	segments of up to 255 ASes. The AS_SEQUENCE following an AS_SET can not
+	be represented, errAsPathSegmentOrder is returned for it.
+*/
+func unmarshalAsPath(in []byte, as4 bool) (ret TypeAsPath, err error) {
+	w := 2
+	if as4 {
+		w = 4
+	}
+	pos := 0
+	for pos < len(in) {
+		if pos+2 > len(in) {
+			err = fmt.Errorf("Truncated AS path segment header")
+			return
+		}
+		t := uint(in[pos])
+		cnt := int(in[pos+1])
+		pos += 2
+		if t != AsPathTypeSet && t != AsPathTypeSequence {
+			err = fmt.Errorf("Invalid AS path segment type %d", t)
+			return
+		}
+		if cnt == 0 {
+			err = fmt.Errorf("Empty AS path segment")
+			return
+		}
+		if pos+cnt*w > len(in) {
+			err = fmt.Errorf("AS path segment exceeds the attribute")
+			return
+		}
+		if t == AsPathTypeSequence && (ret.Type == AsPathTypeSet || len(ret.Set) > 0) {
+			err = errAsPathSegmentOrder
+			return
+		}
+		if ret.Type == 0 {
+			ret.Type = t
+		}
+		for i := 0; i < cnt; i++ {
+			if t == AsPathTypeSet && ret.Type != AsPathTypeSet {
+				ret.Set = append(ret.Set, unmarshalAS(in[pos:pos+w]))
+			} else {
+				ret.Path = append(ret.Path, unmarshalAS(in[pos:pos+w]))
+			}
+			pos += w
+		}
+	}
+	return
+}
+
+/*
+	Check whether the path contains an AS number not fitting into 2 octets
+*/
+func (p TypeAsPath) hasAS4() bool {
+	for _, v := range append(append([]uint32{}, p.Path...), p.Set...) {
+		if v > 0xffff {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Return the number of ASes of the path, the AS_SET counts as one
+*/
+func (p TypeAsPath) length() (n int) {
+	n = len(p.Path)
+	if p.Type == AsPathTypeSet && n > 0 {
+		n = 1
+	}
+	if len(p.Set) > 0 {
+		n++
+	}
+	return
+}
+
+/*
+	Merge the AS path with the AS4_PATH, RFC 6793 section 4.2.3, the leading
+	ASes of the AS path not covered by the AS4_PATH are kept. The AS4_PATH
+	longer than the AS path is ignored.
+*/
+func mergeAs4Path(p, p4 TypeAsPath) TypeAsPath {
+	n := p.length() - p4.length()
+	if n < 0 || n > len(p.Path) || (n > 0 && (p.Type == AsPathTypeSet || p4.Type == AsPathTypeSet)) {
+		return p
+	}
+	ret := TypeAsPath{Type: p.Type, Set: p4.Set}
+	ret.Path = append(append([]uint32{}, p.Path[:n]...), p4.Path...)
+	if n == 0 {
+		ret.Type = p4.Type
+	}
+	return ret
+}
+
+/*
+	Decode the AS number encoded in 2 or 4 octets
+*/
+func unmarshalAS(in []byte) uint32 {
+	if len(in) == 4 {
+		return binary.BigEndian.Uint32(in)
+	}
+	return uint32(binary.BigEndian.Uint16(in))
+}
+
+func unmarshalMessageUpdate(in []byte, p sessionParams) (ret MsgUpdate, err error) {
 	/*
 		Withdrawn prefixes
 	*/
-	cntw := binary.BigEndian.Uint16(in[:2])
-	if cntw%5 != 0 {
-		err = fmt.Errorf("Invalid withdrawn length")
+	if len(in) < 4 {
+		err = fmt.Errorf("Message too small")
 		return
 	}
-	pos := 2
-	var n net.IPNet
-	for i := 0; i < int(cntw/5); i++ {
-		n.Mask = net.CIDRMask(int(in[pos]), 32)
-		n.IP = net.IPv4(in[pos+1], in[pos+2], in[pos+3], in[pos+4])
-		ret.Withdrawns = append(ret.Withdrawns, n.String())
-		pos += 5
+	/*
+		The length is in octets of the variable length prefixes, which
+		are walked until it is consumed
+	*/
+	cntw := int(binary.BigEndian.Uint16(in[:2]))
+	if 2+cntw+2 > len(in) {
+		// UPDATE Message Error, Malformed Attribute List
+		err = newNotificationError(3, 1, nil, "Invalid withdrawn routes length %d", cntw)
+		return
+	}
+	ret.Withdrawns, err = unmarshalPrefixes(in[2 : 2+cntw])
+	if err != nil {
+		// UPDATE Message Error, Invalid Network Field
+		err = newNotificationError(3, 10, nil, "Invalid withdrawn routes: %v", err)
+		return
 	}
+	pos := 2 + cntw
 
 	/*
 		Attributes length
 	*/
 	attrlen := binary.BigEndian.Uint16(in[pos : pos+2])
 	if attrlen == 0 {
+		/*
+			Only withdrawals may be carried without attributes
+		*/
+		if len(in) > pos+2 {
+			// UPDATE Message Error, Malformed Attribute List
+			err = newNotificationError(3, 1, nil, "NLRI without attributes")
+		}
 		return
 	}
 
@@ -182,63 +868,237 @@ func unmarshalMessageUpdate(in []byte) (ret MsgUpdate, err error) {
 	*/
 	pos += 2
 	attrEnd := pos + int(attrlen)
+	if attrEnd > len(in) {
+		// UPDATE Message Error, Malformed Attribute List
+		err = newNotificationError(3, 1, nil, "Invalid attributes length")
+		return
+	}
+
+	var as4Path TypeAsPath
+	var hasAs4Path bool
+	var withdraw bool
+	var as4Aggregator uint32
 	for pos < attrEnd {
-		// NOT well-known attribute, skipping it
-		if in[pos] != 0x40 {
-			pos += int(in[pos+2]) + 3
-			continue
+		start := pos
+		if pos+3 > attrEnd {
+			// UPDATE Message Error, Malformed Attribute List
+			err = newNotificationError(3, 1, nil, "Truncated attribute")
+			return
 		}
+		flags := in[pos]
+		t := in[pos+1]
+		pos += 2
 
-		switch in[pos+1] {
-		case attributeTypeOrigin:
-			pos += 3
-			ret.Origin = uint(in[pos])
+		var l int
+		if flags&attributeFlagExtendedLength != 0 {
+			if pos+2 > attrEnd {
+				// UPDATE Message Error, Malformed Attribute List
+				err = newNotificationError(3, 1, nil, "Truncated attribute")
+				return
+			}
+			l = int(binary.BigEndian.Uint16(in[pos : pos+2]))
+			pos += 2
+		} else {
+			l = int(in[pos])
 			pos++
+		}
+		if pos+l > attrEnd {
+			// UPDATE Message Error, Malformed Attribute List
+			err = newNotificationError(3, 1, nil, "Attribute length exceeds attributes")
+			return
+		}
+		v := in[pos : pos+l]
+		pos += l
+
+		if t < 64 {
+			ret.Present |= 1 << t
+		}
+
+		switch t {
+		case attributeTypeOrigin:
+			if l != 1 {
+				err = fmt.Errorf("Invalid origin attribute length")
+				return
+			}
+			ret.Origin = Origin(v[0])
+			if !ret.Origin.Valid() {
+				// UPDATE Message Error, Invalid ORIGIN Attribute
+				err = newNotificationError(3, 6, in[start:pos], "Invalid origin %d", v[0])
+				return
+			}
 		case attributeTypeAsPath:
-			pos += 3
-			ret.AsPath.Type = uint(in[pos])
-			pos++
-			aplen := int(in[pos])
-			pos++
-			var ap uint16
-			for i := 0; i < aplen; i++ {
-				ap = binary.BigEndian.Uint16(in[pos : pos+2])
-				ret.AsPath.Path = append(ret.AsPath.Path, ap)
-				pos += 2
+			ret.AsPath, err = unmarshalAsPath(v, p.AS4)
+			if errors.Is(err, errAsPathSegmentOrder) {
+				/*
+					Valid AS path which can not be represented, the routes
+					are treated as withdrawn, RFC 7606
+				*/
+				ret.AsPath = TypeAsPath{}
+				withdraw = true
+				err = nil
+			}
+			if err != nil {
+				// UPDATE Message Error, Malformed AS_PATH
+				err = newNotificationError(3, 11, nil, "%v", err)
+				return
 			}
 		case attributeTypeNextHop:
-			pos += 2
-			if uint(in[pos])%4 != 0 {
+			if l%4 != 0 {
 				err = fmt.Errorf("Invalid nexthop attribute length")
 				return
 			}
-			gws := int(in[pos]) / 4
-			pos++
-			var h string
-			for i := 0; i < gws; i++ {
-				h = net.IPv4(in[pos], in[pos+1], in[pos+2], in[pos+3]).String()
-				ret.NextHops = append(ret.NextHops, h)
-				pos += 4
+			for i := 0; i < l; i += 4 {
+				ret.NextHops = append(ret.NextHops, net.IPv4(v[i], v[i+1], v[i+2], v[i+3]).String())
+			}
+		case attributeTypeMultiExitDisc:
+			if l != 4 {
+				err = fmt.Errorf("Invalid MED attribute length")
+				return
+			}
+			ret.MED = binary.BigEndian.Uint32(v)
+		case attributeTypeLocalPref:
+			if l != 4 {
+				err = fmt.Errorf("Invalid local preference attribute length")
+				return
+			}
+			ret.LocalPref = binary.BigEndian.Uint32(v)
+		case attributeTypeAtomicAggregate:
+			ret.AtomicAggregate = true
+		case attributeTypeAggregator:
+			if (p.AS4 && l != 8) || (!p.AS4 && l != 6) {
+				err = fmt.Errorf("Invalid aggregator attribute length")
+				return
+			}
+			ret.Aggregator.ASN = unmarshalAS(v[:l-4])
+			ret.Aggregator.Address = net.IPv4(v[l-4], v[l-3], v[l-2], v[l-1]).String()
+		case attributeTypeMpReachNLRI:
+			if l < 5 || l < 5+int(v[3]) {
+				err = fmt.Errorf("Invalid MP_REACH_NLRI attribute length")
+				return
+			}
+			if binary.BigEndian.Uint16(v[0:2]) == afiIPv4 && v[2] == safiFlowSpec {
+				var x []FlowSpecRule
+				x, err = unmarshalFlowSpecNLRI(v[5+int(v[3]):])
+				if err != nil {
+					return
+				}
+				ret.FlowSpec = append(ret.FlowSpec, x...)
+				break
+			}
+			if binary.BigEndian.Uint16(v[0:2]) != afiIPv4 || v[2] != safiUnicast {
+				// Other address families are not supported, skipping it
+				break
+			}
+			nh := v[4 : 4+int(v[3])]
+			if len(nh)%4 != 0 {
+				err = fmt.Errorf("Invalid MP_REACH_NLRI next hop length")
+				return
+			}
+			for i := 0; i < len(nh); i += 4 {
+				ret.NextHops = append(ret.NextHops, net.IPv4(nh[i], nh[i+1], nh[i+2], nh[i+3]).String())
+			}
+			var x []string
+			x, err = unmarshalPrefixes(v[5+len(nh):])
+			if err != nil {
+				return
+			}
+			ret.Prefixes = append(ret.Prefixes, x...)
+		case attributeTypeMpUnreachNLRI:
+			if l < 3 {
+				err = fmt.Errorf("Invalid MP_UNREACH_NLRI attribute length")
+				return
+			}
+			if binary.BigEndian.Uint16(v[0:2]) == afiIPv4 && v[2] == safiFlowSpec {
+				var x []FlowSpecRule
+				x, err = unmarshalFlowSpecNLRI(v[3:])
+				if err != nil {
+					return
+				}
+				ret.FlowSpecWithdrawns = append(ret.FlowSpecWithdrawns, x...)
+				break
+			}
+			if binary.BigEndian.Uint16(v[0:2]) != afiIPv4 || v[2] != safiUnicast {
+				// Other address families are not supported, skipping it
+				break
+			}
+			var x []string
+			x, err = unmarshalPrefixes(v[3:])
+			if err != nil {
+				return
+			}
+			ret.Withdrawns = append(ret.Withdrawns, x...)
+		case attributeTypeCommunities:
+			if l%4 != 0 {
+				err = fmt.Errorf("Invalid communities attribute length")
+				return
+			}
+			for i := 0; i < l; i += 4 {
+				ret.Communities = append(ret.Communities, binary.BigEndian.Uint32(v[i:i+4]))
+			}
+		case attributeTypeExtendedCommunities:
+			if l%8 != 0 {
+				err = fmt.Errorf("Invalid extended communities attribute length")
+				return
+			}
+			for i := 0; i < l; i += 8 {
+				ret.ExtendedCommunities = append(ret.ExtendedCommunities, binary.BigEndian.Uint64(v[i:i+8]))
+			}
+		case attributeTypeAs4Path:
+			if !p.AS4 {
+				/*
+					Malformed AS4_PATH is ignored, RFC 6793
+				*/
+				var e error
+				as4Path, e = unmarshalAsPath(v, true)
+				hasAs4Path = e == nil
+			}
+		case attributeTypeAs4Aggregator:
+			if !p.AS4 && l == 8 {
+				as4Aggregator = binary.BigEndian.Uint32(v[0:4])
 			}
 		default:
-			pos += int(in[pos])
+			if p.StrictAttributes && flags&attributeFlagOptional == 0 {
+				// UPDATE Message Error, Unrecognized Well-known Attribute
+				err = newNotificationError(3, 2, in[start:pos], "Unrecognized well-known attribute %d", t)
+				return
+			}
+			// Unknown attribute, skipping it
 		}
+	}
 
+	/*
+		Reconstruct the 4-octet AS numbers replaced by AS_TRANS, the AS4_PATH
+		is ignored if the aggregator was not a 4-octet AS speaker
+	*/
+	if as4Aggregator != 0 && ret.Aggregator.ASN == asTrans {
+		ret.Aggregator.ASN = as4Aggregator
+	} else if ret.Aggregator.ASN != 0 && ret.Aggregator.ASN != asTrans {
+		hasAs4Path = false
+	}
+	if hasAs4Path {
+		ret.AsPath = mergeAs4Path(ret.AsPath, as4Path)
 	}
 
+	/*
+		Actions of the received flow specification
+	*/
+	applyFlowSpecActions(ret.FlowSpec, ret.ExtendedCommunities)
+
 	/*
 		Announced prefixes
 	*/
-	if (len(in)-pos)%5 != 0 {
-		err = fmt.Errorf("Invalid NLRI specification")
+	var x []string
+	x, err = unmarshalPrefixes(in[pos:])
+	if err != nil {
 		return
 	}
-	cnt := (len(in) - pos) / 5
-	for i := 0; i < cnt; i++ {
-		n.Mask = net.CIDRMask(int(in[pos]), 32)
-		n.IP = net.IPv4(in[pos+1], in[pos+2], in[pos+3], in[pos+4])
-		ret.Prefixes = append(ret.Prefixes, n.String())
-		pos += 5
+	ret.Prefixes = append(ret.Prefixes, x...)
+
+	if withdraw {
+		ret.Withdrawns = append(ret.Withdrawns, ret.Prefixes...)
+		ret.Prefixes = nil
+		ret.FlowSpecWithdrawns = append(ret.FlowSpecWithdrawns, ret.FlowSpec...)
+		ret.FlowSpec = nil
 	}
 
 	return
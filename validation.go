@@ -0,0 +1,108 @@
+package gobgp
+
+/*
+	Origin validation state of a route, RFC 6811
+*/
+type ValidationState uint8
+
+const (
+	ValidationNone ValidationState = iota
+	ValidationValid
+	ValidationNotFound
+	ValidationInvalid
+)
+
+var validationStateNames = map[ValidationState]string{
+	ValidationNone:     "None",
+	ValidationValid:    "Valid",
+	ValidationNotFound: "NotFound",
+	ValidationInvalid:  "Invalid",
+}
+
+func (s ValidationState) String() string {
+	if n, ok := validationStateNames[s]; ok {
+		return n
+	}
+	return "Unknown"
+}
+
+/*
+	Origin validation state extended community, RFC 8097
+*/
+const extCommunityValidationState = 0x4300
+
+/*
+	Return the extended community carrying the validation state
+*/
+func (s ValidationState) extendedCommunity() (uint64, bool) {
+	switch s {
+	case ValidationValid:
+		return extCommunityValidationState<<48 | 0, true
+	case ValidationNotFound:
+		return extCommunityValidationState<<48 | 1, true
+	case ValidationInvalid:
+		return extCommunityValidationState<<48 | 2, true
+	}
+	return 0, false
+}
+
+/*
+	Return the validation state carried by the extended communities
+*/
+func validationStateFromCommunities(comms []uint64) ValidationState {
+	for _, c := range comms {
+		if c>>48 != extCommunityValidationState {
+			continue
+		}
+		switch c & 0xff {
+		case 0:
+			return ValidationValid
+		case 1:
+			return ValidationNotFound
+		case 2:
+			return ValidationInvalid
+		}
+	}
+	return ValidationNone
+}
+
+/*
+	Return the origin AS of the path, zero if it ends by an AS_SET,
+	the local AS for the empty path of the iBGP peer
+*/
+func (b *BGP) originAS(p TypeAsPath) uint32 {
+	if len(p.Set) > 0 || p.Type == AsPathTypeSet {
+		return 0
+	}
+	if len(p.Path) == 0 {
+		return b.as
+	}
+	return p.Path[len(p.Path)-1]
+}
+
+/*
+	Return the validation state of the received route, by the validator
+	if set, otherwise as signalled by the peer
+*/
+func (b *BGP) validationState(prefix string, m MsgUpdate) ValidationState {
+	if b.validator != nil {
+		return b.validator(prefix, b.originAS(m.AsPath))
+	}
+	return validationStateFromCommunities(m.ExtendedCommunities)
+}
+
+/*
+	Add prefix to the internal database and send update to the BGP peer
+	signalling the origin validation state by the extended community, RFC 8097
+*/
+func (b *BGP) AddValidated(p string, o Origin, a TypeAsPath, n []string, s ValidationState) error {
+	var m MsgUpdate
+	m.Prefixes = []string{p}
+	m.Origin = o
+	m.AsPath = a
+	m.NextHops = n
+	if c, ok := s.extendedCommunity(); ok {
+		m.ExtendedCommunities = []uint64{c}
+	}
+	return b.add(m)
+}
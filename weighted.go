@@ -0,0 +1,197 @@
+package gobgp
+
+import (
+	"fmt"
+	"math"
+)
+
+/*
+	Link bandwidth extended community, draft-ietf-idr-link-bandwidth
+*/
+const extCommunityLinkBandwidth = 0x4004
+
+/*
+	Path of the prefix advertised with the bandwidth of the link,
+	downstream routers balance the traffic by the bandwidth ratio
+*/
+type WeightedPath struct {
+	NextHop string
+	AsPath  TypeAsPath
+
+	/*
+		Bandwidth of the link in bytes per second
+	*/
+	Bandwidth float32
+}
+
+/*
+	Return the link bandwidth extended community
+*/
+func linkBandwidth(as uint32, bw float32) uint64 {
+	if as > 0xffff {
+		as = asTrans
+	}
+	return uint64(extCommunityLinkBandwidth)<<48 | uint64(as)<<32 | uint64(math.Float32bits(bw))
+}
+
+/*
+	Add the prefix advertised over multiple paths with the link bandwidth,
+	each path is sent with its own path identifier. Only the first path
+	is sent if the peer does not accept ADD-PATH.
+*/
+func (b *BGP) AddWeighted(prefix string, paths []WeightedPath) error {
+	if !b.addPath {
+		return fmt.Errorf("AddWeighted: ADD-PATH not enabled")
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("AddWeighted: No paths defined")
+	}
+	if b.Exists(prefix) {
+		return fmt.Errorf("AddWeighted: Prefix %s alredy exists", prefix)
+	}
+	if err := b.checkMartian(prefix); err != nil {
+		return fmt.Errorf("AddWeighted: %w", err)
+	}
+
+	p := b.validationParams()
+	p.AddPath = true
+
+	var ms []MsgUpdate
+	for i, v := range paths {
+		if v.Bandwidth < 0 {
+			return fmt.Errorf("AddWeighted: Invalid bandwidth %v", v.Bandwidth)
+		}
+		m := MsgUpdate{
+			Prefixes:            []string{prefix},
+			Origin:              OriginTypeIGP,
+			AsPath:              v.AsPath,
+			NextHops:            []string{v.NextHop},
+			ExtendedCommunities: []uint64{linkBandwidth(b.as, v.Bandwidth)},
+			PathID:              uint32(i + 1),
+		}
+		if _, err := marshalMessageUpdate(m, p); err != nil {
+			return fmt.Errorf("AddWeighted: %v", err)
+		}
+		ms = append(ms, m)
+	}
+
+	now := b.clock.Now()
+	b.mu.Lock()
+	if b.exists(prefix) {
+		b.mu.Unlock()
+		return fmt.Errorf("AddWeighted: Prefix %s alredy exists", prefix)
+	}
+	b.weighted[prefix] = ms
+	b.trie.insert(prefix)
+	b.advertised[prefix] = now
+	b.mu.Unlock()
+	b.debug("Adding prefix %s over %d paths", prefix, len(ms))
+
+	return b.writeWeighted(ms)
+}
+
+/*
+	Withdraw all paths of the prefix
+*/
+func (b *BGP) delWeighted(prefix string) error {
+	b.mu.Lock()
+	ms, ok := b.weighted[prefix]
+	if ok {
+		delete(b.weighted, prefix)
+		b.trie.remove(prefix)
+		delete(b.advertised, prefix)
+	}
+	b.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("Del: Prefix %s not found", prefix)
+	}
+	b.debug("Removing prefix %s over %d paths", prefix, len(ms))
+
+	var ws []MsgUpdate
+	for _, m := range ms {
+		ws = append(ws, MsgUpdate{Withdrawns: m.Prefixes, PathID: m.PathID})
+	}
+	return b.writeWeighted(ws)
+}
+
+/*
+	Withdraw the single path of the prefix added by AddWeighted, the other
+	paths stay advertised. The prefix is removed with its last path.
+*/
+func (b *BGP) DelPath(prefix string, pathID uint32) error {
+	b.mu.Lock()
+	ms, ok := b.weighted[prefix]
+	if !ok {
+		b.mu.Unlock()
+		return fmt.Errorf("DelPath: Prefix %s not found", prefix)
+	}
+	i := 0
+	for i < len(ms) && ms[i].PathID != pathID {
+		i++
+	}
+	if i == len(ms) {
+		b.mu.Unlock()
+		return fmt.Errorf("DelPath: Path %d of prefix %s not found", pathID, prefix)
+	}
+	if len(ms) == 1 {
+		b.mu.Unlock()
+		return b.delWeighted(prefix)
+	}
+	rest := append(append([]MsgUpdate{}, ms[:i]...), ms[i+1:]...)
+	b.weighted[prefix] = rest
+	b.mu.Unlock()
+
+	b.debug("Removing path %d of prefix %s", pathID, prefix)
+
+	if b.sessionParams().AddPath {
+		return b.writeUpdate(MsgUpdate{Withdrawns: ms[i].Prefixes, PathID: pathID})
+	}
+	/*
+		Only the first path is known to the peer, it is replaced
+		by the next one
+	*/
+	if i == 0 {
+		return b.writeUpdate(rest[0])
+	}
+	return nil
+}
+
+/*
+	Advertise all prefixes with multiple paths, used after a reconnect
+*/
+func (b *BGP) sendWeighted() {
+	for _, ms := range b.weightedRoutes() {
+		if err := b.writeWeighted(ms); err != nil {
+			b.reportError("sendWeighted", err)
+		}
+	}
+}
+
+/*
+	Return the copy of the prefixes with multiple paths
+*/
+func (b *BGP) weightedRoutes() map[string][]MsgUpdate {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ret := make(map[string][]MsgUpdate, len(b.weighted))
+	for k, v := range b.weighted {
+		ret[k] = v
+	}
+	return ret
+}
+
+/*
+	Send the updates of the paths bypassing the batching, which identifies
+	the routes by the prefix only
+*/
+func (b *BGP) writeWeighted(ms []MsgUpdate) error {
+	if !b.sessionParams().AddPath && len(ms) > 1 {
+		ms = ms[:1]
+	}
+	for _, m := range ms {
+		if err := b.writeUpdate(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}